@@ -0,0 +1,134 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// NewBuilding - create a building of several storeys, with optional basements
+// and a roof, as dungeon levels from the top down.
+// All storeys share the outer walls, and load-bearing walls that divide the
+// building into sections; each storey partitions the sections into rooms
+// differently. A stairwell runs through every storey, and the stairs
+// alternate sides so that they line up between storeys.
+// The ground floor has an entrance in its bottom wall.
+func NewBuilding(rr *rand.Rand, width, height, numFloors, numBasements, minRoomSize, maxRoomSize int, roof bool) *Dungeon {
+	// Load-bearing sections, with the stairwell taken from the widest
+	sections := splitInteriorRooms(rr, bspRoomRoot(width, height), minRoomSize*2, maxRoomSize*2)
+	widest := 0
+	for i := range sections {
+		if sections[i].r.w > sections[widest].r.w {
+			widest = i
+		}
+	}
+	var stairwell bspRoom
+	if sections[widest].r.w-3 >= minRoomSize {
+		stairwell = sections[widest]
+		stairwell.r.x += stairwell.r.w - 3
+		stairwell.r.w = 3
+		sections[widest].r.w -= 3
+	} else {
+		stairwell = sections[widest]
+		sections = append(sections[:widest], sections[widest+1:]...)
+	}
+	// Stairs go in the first two tiles inside the stairwell
+	walled := sharedWalls(stairwell.r)
+	inner := rect{walled.x + 1, walled.y + 1, walled.w - 2, walled.h - 2}
+	stairs := []vec2{{inner.x, inner.y}, {inner.x + 1, inner.y}}
+	if inner.w < 2 {
+		stairs[1] = vec2{inner.x, inner.y + 1}
+	}
+
+	var names []string
+	if roof {
+		names = append(names, "Roof")
+	}
+	for i := numFloors; i > 1; i-- {
+		names = append(names, fmt.Sprintf("Floor %d", i))
+	}
+	names = append(names, "Ground floor")
+	for i := 1; i <= numBasements; i++ {
+		names = append(names, fmt.Sprintf("Basement %d", i))
+	}
+
+	d := &Dungeon{}
+	for level, name := range names {
+		m := NewMap(width, height)
+		g := m.Layer("Ground")
+		s := m.Layer("Structures")
+		if roof && level == 0 {
+			addBuildingRoof(g, s, stairwell)
+		} else {
+			tile := room
+			if level > len(names)-1-numBasements {
+				tile = floor
+			}
+			addBuildingStorey(rr, g, s, sections, stairwell, minRoomSize, maxRoomSize, tile)
+		}
+		if name == "Ground floor" {
+			addBuildingEntrance(rr, g, s)
+		}
+		d.addLevel(m, name)
+		if level > 0 {
+			up := stairs[(level-1)%2]
+			s.setTile(up.x, up.y, stairsUp)
+			d.link(level-1, up.x, up.y, up.x, up.y)
+		}
+		if level < len(names)-1 {
+			down := stairs[level%2]
+			s.setTile(down.x, down.y, stairsDown)
+		}
+		m.AddObject("Stairwell", "stairwell", walled.x, walled.y, walled.w, walled.h,
+			map[string]string{})
+	}
+	return d
+}
+
+// A storey: partition each section into rooms, and connect them to the
+// stairwell
+func addBuildingStorey(rr *rand.Rand, g, s *Layer, sections []bspRoom, stairwell bspRoom, minRoomSize, maxRoomSize int, tile rune) {
+	var rooms []bspRoom
+	for _, section := range sections {
+		section.parent, section.child1, section.child2 = -1, -1, -1
+		rooms = append(rooms, splitInteriorRooms(rr, section, minRoomSize, maxRoomSize)...)
+	}
+	rooms = append(rooms, stairwell)
+	addInteriorRooms(g, s, rooms, tile)
+	lobby := rooms[len(rooms)-1]
+	g.rectangleFilled(rect{lobby.r.x + 1, lobby.r.y + 1, lobby.r.w - 2, lobby.r.h - 2}, room2)
+	connectInteriorRooms(g, s, rooms, lobby, room2)
+}
+
+// The roof: open, surrounded by a parapet, with a door out of the stairwell
+func addBuildingRoof(g, s *Layer, stairwell bspRoom) {
+	s.rectangleUnfilled(rect{0, 0, g.Width, g.Height}, wall2)
+	g.rectangleFilled(rect{1, 1, g.Width - 2, g.Height - 2}, room2)
+	rooms := []bspRoom{stairwell}
+	addInteriorRooms(g, s, rooms, room2)
+	r := rooms[0].r
+	for _, d := range []vec2{{r.x, r.y + r.h/2}, {r.x + r.w/2, r.y + r.h - 1},
+		{r.x + r.w/2, r.y}, {r.x + r.w - 1, r.y + r.h/2}} {
+		if d.x > 0 && d.y > 0 && d.x < g.Width-1 && d.y < g.Height-1 {
+			s.setTile(d.x, d.y, door)
+			return
+		}
+	}
+}
+
+// Place a door in the outer bottom wall, into a room behind it
+func addBuildingEntrance(rr *rand.Rand, g, s *Layer) {
+	var xs []int
+	y := g.Height - 1
+	for x := 1; x < g.Width-1; x++ {
+		if s.getTile(x, y) == wall2 && s.getTile(x, y-1) == nothing &&
+			s.getTile(x-1, y-1) == nothing && s.getTile(x+1, y-1) == nothing {
+			xs = append(xs, x)
+		}
+	}
+	if len(xs) == 0 {
+		return
+	}
+	x := xs[rr.Intn(len(xs))]
+	g.setTile(x, y, room2)
+	s.setTile(x, y, door)
+}
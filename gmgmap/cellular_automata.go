@@ -1,6 +1,13 @@
 package gmgmap
 
-import "math/rand"
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
 const (
 	floorTile = floor
@@ -12,14 +19,73 @@ const (
 // If the number of stones within one step (including itself) is at least r1 OR
 // the number of stones within 2 steps at most r2, turn into a stone,
 // else turn into a floor
+// Then connect the disconnected areas, see connectAreas
 func NewCellularAutomata(rr *rand.Rand, width, height, fillPct, repeat, r1, r2 int) *Map {
+	return NewCellularAutomataWithOptions(rr, width, height, fillPct, repeat, r1, r2, CaveOptions{})
+}
 
+// CaveOptions - how the areas of cellular automata caves are connected.
+// The zero value chains the areas together with straight tunnels, keeping
+// every area.
+type CaveOptions struct {
+	Connect     int // ConnectChain or ConnectMST
+	Tunnel      int // TunnelStraight or TunnelOrganic
+	MinAreaSize int // fill in areas smaller than this instead of connecting them
+}
+
+// NewCellularAutomataWithOptions - create a cellular automata cave like
+// NewCellularAutomata, choosing how its areas are connected
+func NewCellularAutomataWithOptions(rr *rand.Rand, width, height, fillPct, repeat, r1, r2 int, opts CaveOptions) *Map {
 	m := NewMap(width, height)
 	g := m.Layer("Ground")
 	g.fill(floorTile)
 	l := m.Layer("Structures")
-	// Randomly set a percentage of the tiles as stones
-	for i := 0; i < fillPct*width*height/100; i++ {
+	fillRandom(rr, l, fillPct)
+	// Repetitions
+	w := newCAWorkspace(l, 2)
+	for i := 0; i < repeat; i++ {
+		rep(l, w, r1, r2)
+	}
+
+	connectAreas(rr, m, g, l, opts.Connect, opts.Tunnel, opts.MinAreaSize)
+
+	return m
+}
+
+// NewCellularAutomataRules - create a stone-on-floor map using cellular
+// automata, applying a schedule of birth/survival rules in order.
+// Stones are live cells; cells outside the map count as stones.
+func NewCellularAutomataRules(rr *rand.Rand, width, height, fillPct int, rules []CARule) *Map {
+	return NewCellularAutomataRulesWithOptions(rr, width, height, fillPct, rules, CaveOptions{})
+}
+
+// NewCellularAutomataRulesWithOptions - create a cellular automata cave like
+// NewCellularAutomataRules, choosing how its areas are connected
+func NewCellularAutomataRulesWithOptions(rr *rand.Rand, width, height, fillPct int, rules []CARule, opts CaveOptions) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	g.fill(floorTile)
+	l := m.Layer("Structures")
+	fillRandom(rr, l, fillPct)
+	maxRadius := 1
+	for _, rule := range rules {
+		maxRadius = imax(maxRadius, rule.Radius)
+	}
+	w := newCAWorkspace(l, maxRadius)
+	for _, rule := range rules {
+		for i := 0; i < rule.Repeat; i++ {
+			rule.apply(l, w)
+		}
+	}
+
+	connectAreas(rr, m, g, l, opts.Connect, opts.Tunnel, opts.MinAreaSize)
+
+	return m
+}
+
+// Randomly set a percentage of the tiles as stones
+func fillRandom(rr *rand.Rand, l *Layer, fillPct int) {
+	for i := 0; i < fillPct*l.Width*l.Height/100; i++ {
 		l.Tiles[i] = roadTile
 	}
 	// Shuffle
@@ -27,11 +93,25 @@ func NewCellularAutomata(rr *rand.Rand, width, height, fillPct, repeat, r1, r2 i
 		j := rr.Intn(i + 1)
 		l.Tiles[i], l.Tiles[j] = l.Tiles[j], l.Tiles[i]
 	}
-	// Repetitions
-	for i := 0; i < repeat; i++ {
-		rep(l, r1, r2)
-	}
+}
+
+// Area connection strategies, for cellular automata caves
+const (
+	ConnectChain = iota // connect random tiles of each area to the next area
+	ConnectMST          // connect nearest areas, as a minimum spanning tree
+)
 
+// Tunnel styles, for connecting cellular automata cave areas
+const (
+	TunnelStraight = iota // S-shaped corridors
+	TunnelOrganic         // biased random walk towards the destination
+)
+
+// Connect the disconnected floor areas of a cave, by digging tunnels
+// through the stones.
+// Areas smaller than minAreaSize are filled in instead, except for the
+// largest area.
+func connectAreas(rr *rand.Rand, m *Map, g, l *Layer, connect, tunnel, minAreaSize int) {
 	// Use flood fill to identify disconnected areas
 	fl := m.Layer("Flood")
 	fl.fill(0)
@@ -51,6 +131,48 @@ func NewCellularAutomata(rr *rand.Rand, width, height, fillPct, repeat, r1, r2 i
 	}
 
 	numAreas := -index - 1
+	areaOf := func(i int) int {
+		return int(-fl.Tiles[i] - 1)
+	}
+	// Cull small areas by filling them with stone
+	areaSizes := make([]int, numAreas)
+	largestArea := 0
+	for i, tile := range fl.Tiles {
+		if tile < 0 {
+			areaSizes[areaOf(i)]++
+		}
+	}
+	for i, size := range areaSizes {
+		if size > areaSizes[largestArea] {
+			largestArea = i
+		}
+	}
+	culled := make([]bool, numAreas)
+	for i, size := range areaSizes {
+		culled[i] = size < minAreaSize && i != largestArea
+	}
+	for i, tile := range fl.Tiles {
+		if tile < 0 && culled[areaOf(i)] {
+			fl.Tiles[i] = roadTile
+			l.Tiles[i] = roadTile
+		}
+	}
+
+	dig := func(x1, y1, x2, y2 int) {
+		if tunnel == TunnelOrganic {
+			addTunnel(rr, g, l, x1, y1, x2, y2, floorTile)
+		} else {
+			addCorridor(g, l, x1, y1, x2, y2, floorTile)
+		}
+	}
+	if connect == ConnectMST {
+		for _, e := range nearestAreaEdges(fl, int(numAreas)) {
+			dig(e.from%l.Width, e.from/l.Width, e.to%l.Width, e.to/l.Width)
+		}
+		m.removeLayer(fl.Name)
+		return
+	}
+
 	// Connect the disconnected areas, first to second, second to third etc.
 	// Select random tile from each area
 	areaTiles := make([]rune, len(fl.Tiles))
@@ -69,30 +191,375 @@ func NewCellularAutomata(rr *rand.Rand, width, height, fillPct, repeat, r1, r2 i
 		}
 	}
 	m.removeLayer(fl.Name)
+	var starts []rune
+	for i, start := range areaStarts {
+		if !culled[i] {
+			starts = append(starts, start)
+		}
+	}
 	// Connect consecutive pairs of tiles
-	for i := 0; i < len(areaStarts)-1; i++ {
-		x1 := int(areaStarts[i]) % l.Width
-		y1 := int(areaStarts[i]) / l.Width
-		x2 := int(areaStarts[i+1]) % l.Width
-		y2 := int(areaStarts[i+1]) / l.Width
-		addCorridor(g, l, x1, y1, x2, y2, floorTile)
+	for i := 0; i < len(starts)-1; i++ {
+		x1 := int(starts[i]) % l.Width
+		y1 := int(starts[i]) / l.Width
+		x2 := int(starts[i+1]) % l.Width
+		y2 := int(starts[i+1]) / l.Width
+		dig(x1, y1, x2, y2)
 	}
+}
 
-	return m
+// Connection between two areas, from a tile of one to the nearest tile of
+// another
+type areaEdge struct {
+	a, b     int
+	from, to int
+	distance int
 }
 
-func rep(l *Layer, r1, r2 int) {
-	buf := make([]rune, len(l.Tiles))
+// Find the edges of a minimum spanning tree connecting the areas of a flood
+// filled layer, where area n has tiles -n-1.
+// Grow all the areas outwards at once through the stone tiles; where two
+// areas meet gives the nearest pair of tiles between them.
+func nearestAreaEdges(fl *Layer, numAreas int) []areaEdge {
+	owner := make([]int, len(fl.Tiles))
+	origin := make([]int, len(fl.Tiles))
+	distance := make([]int, len(fl.Tiles))
+	var frontier []int
+	for i, tile := range fl.Tiles {
+		owner[i] = -1
+		if tile < 0 {
+			owner[i] = int(-tile - 1)
+			origin[i] = i
+			frontier = append(frontier, i)
+		}
+	}
+	candidates := map[[2]int]areaEdge{}
+	for len(frontier) > 0 {
+		i := frontier[0]
+		frontier = frontier[1:]
+		x, y := i%fl.Width, i/fl.Width
+		for _, d := range []vec2{{0, -1}, {1, 0}, {0, 1}, {-1, 0}} {
+			if !fl.isIn(x+d.x, y+d.y) {
+				continue
+			}
+			j := x + d.x + (y+d.y)*fl.Width
+			if owner[j] < 0 {
+				owner[j] = owner[i]
+				origin[j] = origin[i]
+				distance[j] = distance[i] + 1
+				frontier = append(frontier, j)
+			} else if owner[j] != owner[i] {
+				e := areaEdge{owner[i], owner[j], origin[i], origin[j],
+					distance[i] + distance[j] + 1}
+				if e.a > e.b {
+					e = areaEdge{e.b, e.a, e.to, e.from, e.distance}
+				}
+				key := [2]int{e.a, e.b}
+				if c, ok := candidates[key]; !ok || e.distance < c.distance {
+					candidates[key] = e
+				}
+			}
+		}
+	}
+	// Kruskal's algorithm; sort for determinism as map order is random
+	edges := make([]areaEdge, 0, len(candidates))
+	for _, e := range candidates {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].distance != edges[j].distance {
+			return edges[i].distance < edges[j].distance
+		}
+		if edges[i].a != edges[j].a {
+			return edges[i].a < edges[j].a
+		}
+		return edges[i].b < edges[j].b
+	})
+	var tree []areaEdge
+	sets := newDisjointSet(numAreas)
+	for _, e := range edges {
+		if sets.union(e.a, e.b) {
+			tree = append(tree, e)
+		}
+	}
+	return tree
+}
+
+// Dig an organic tunnel using a random walk biased towards the destination
+// Like addCorridor, the ground tile is drawn and the structure layer cleared
+func addTunnel(rr *rand.Rand, g, s *Layer, startX, startY, endX, endY int, tile rune) {
+	x, y := startX, startY
+	for {
+		g.setTile(x, y, tile)
+		s.setTile(x, y, nothing)
+		if x == endX && y == endY {
+			break
+		}
+		// Mostly step towards the destination, favouring the longer axis,
+		// otherwise wander
+		if rr.Intn(3) > 0 {
+			dx, dy := endX-x, endY-y
+			if rr.Intn(Abs(dx)+Abs(dy)) < Abs(dx) {
+				if dx > 0 {
+					x++
+				} else {
+					x--
+				}
+			} else if dy > 0 {
+				y++
+			} else {
+				y--
+			}
+		} else {
+			x, y = randomWalk(rr, x, y, g.Width, g.Height)
+		}
+	}
+}
+
+func rep(l *Layer, w *caWorkspace, r1, r2 int) {
+	w.sat.update(l, roadTile)
 	for y := 0; y < l.Height; y++ {
 		for x := 0; x < l.Width; x++ {
 			i := x + y*l.Width
-			if l.countTiles(x, y, 1, roadTile) >= r1 ||
-				l.countTiles(x, y, 2, roadTile) <= r2 {
-				buf[i] = roadTile
+			if w.sat.count(x, y, 1) >= r1 || w.sat.count(x, y, 2) <= r2 {
+				w.buf[i] = roadTile
 			} else {
-				buf[i] = floorTile
+				w.buf[i] = floorTile
+			}
+		}
+	}
+	w.swap(l)
+}
+
+// Scratch space reused across cellular automata repetitions, so that we
+// don't need to reallocate per repetition
+type caWorkspace struct {
+	buf []rune
+	sat *summedAreaTable
+}
+
+func newCAWorkspace(l *Layer, pad int) *caWorkspace {
+	return &caWorkspace{make([]rune, len(l.Tiles)), newSummedAreaTable(l, pad)}
+}
+
+// Swap in the next generation; the current tiles become the next buffer
+func (w *caWorkspace) swap(l *Layer) {
+	l.Tiles, w.buf = w.buf, l.Tiles
+}
+
+// Summed-area table (integral image) for counting tiles in square windows in
+// constant time.
+// The table is padded, and tiles outside the layer are counted, the same as
+// Layer.countTiles.
+type summedAreaTable struct {
+	sums   []int
+	stride int
+	pad    int
+}
+
+func newSummedAreaTable(l *Layer, pad int) *summedAreaTable {
+	stride := l.Width + 2*pad + 1
+	return &summedAreaTable{
+		make([]int, stride*(l.Height+2*pad+1)), stride, pad}
+}
+
+// Recalculate the table for the number of matching tiles
+func (t *summedAreaTable) update(l *Layer, tile rune) {
+	for py := 0; py < l.Height+2*t.pad; py++ {
+		rowSum := 0
+		for px := 0; px < l.Width+2*t.pad; px++ {
+			x, y := px-t.pad, py-t.pad
+			if !l.isIn(x, y) || l.Tiles[x+y*l.Width] == tile {
+				rowSum++
+			}
+			t.sums[px+1+(py+1)*t.stride] = t.sums[px+1+py*t.stride] + rowSum
+		}
+	}
+}
+
+// Count the number of matching tiles within r of a tile, including itself
+// r must not exceed the table padding
+func (t *summedAreaTable) count(x, y, r int) int {
+	x0, y0 := x+t.pad-r, y+t.pad-r
+	x1, y1 := x+t.pad+r+1, y+t.pad+r+1
+	return t.sums[x1+y1*t.stride] - t.sums[x0+y1*t.stride] -
+		t.sums[x1+y0*t.stride] + t.sums[x0+y0*t.stride]
+}
+
+// Neighbourhood types for cellular automata rules
+const (
+	NeighbourhoodMoore      = iota // square, up to radius steps in each axis
+	NeighbourhoodVonNeumann        // diamond, up to radius steps in total
+)
+
+// CARule - a birth/survival cellular automata rule, e.g. B5678/S45678
+// Birth and Survival are indexed by the number of stone neighbours, excluding
+// the tile itself.
+type CARule struct {
+	Birth         []bool
+	Survival      []bool
+	Neighbourhood int
+	Radius        int
+	Repeat        int
+}
+
+// ParseCARules - parse a cellular automata rule schedule.
+// The schedule is a comma-separated list of rulestrings, applied in order.
+// Each rulestring is B/S notation (e.g. B5678/S45678), optionally followed by
+// a neighbourhood and radius (/M2 for Moore, /N1 for von Neumann; default /M1)
+// and a number of repetitions (x4; default 1).
+// Neighbour counts are listed as single digits, or as a range (e.g. B12-20)
+// for larger neighbourhoods.
+// For example, B5678/S45678x4,B5678/S5678x3 is the 4-5 rule for 4 passes,
+// followed by 3 passes of smoothing.
+func ParseCARules(s string) ([]CARule, error) {
+	var rules []CARule
+	for _, step := range strings.Split(s, ",") {
+		rule, err := parseCARule(strings.TrimSpace(step))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseCARule(s string) (CARule, error) {
+	rule := CARule{nil, nil, NeighbourhoodMoore, 1, 1}
+	if i := strings.LastIndexAny(s, "xX"); i >= 0 {
+		repeat, err := strconv.Atoi(s[i+1:])
+		if err != nil || repeat < 0 {
+			return rule, fmt.Errorf("invalid repetitions in rule %q", s)
+		}
+		rule.Repeat = repeat
+		s = s[:i]
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return rule, fmt.Errorf("invalid rule %q, expected B.../S...", s)
+	}
+	if len(parts) == 3 {
+		n := parts[2]
+		if n == "" {
+			return rule, fmt.Errorf("invalid neighbourhood in rule %q", s)
+		}
+		switch unicode.ToUpper(rune(n[0])) {
+		case 'M':
+			rule.Neighbourhood = NeighbourhoodMoore
+		case 'N':
+			rule.Neighbourhood = NeighbourhoodVonNeumann
+		default:
+			return rule, fmt.Errorf("unknown neighbourhood in rule %q", s)
+		}
+		if len(n) > 1 {
+			radius, err := strconv.Atoi(n[1:])
+			if err != nil || radius < 1 {
+				return rule, fmt.Errorf("invalid radius in rule %q", s)
 			}
+			rule.Radius = radius
 		}
 	}
-	l.Tiles = buf
+	maxCount := rule.maxNeighbours()
+	for _, part := range parts[:2] {
+		if part == "" {
+			return rule, fmt.Errorf("invalid rule %q", s)
+		}
+		counts, err := parseCACounts(part[1:], maxCount)
+		if err != nil {
+			return rule, fmt.Errorf("%s in rule %q", err, s)
+		}
+		switch unicode.ToUpper(rune(part[0])) {
+		case 'B':
+			rule.Birth = counts
+		case 'S':
+			rule.Survival = counts
+		default:
+			return rule, fmt.Errorf("invalid rule %q, expected B.../S...", s)
+		}
+	}
+	if rule.Birth == nil || rule.Survival == nil {
+		return rule, fmt.Errorf("invalid rule %q, expected B.../S...", s)
+	}
+	return rule, nil
+}
+
+// Parse neighbour counts, either as digits or a single lo-hi range
+func parseCACounts(s string, maxCount int) ([]bool, error) {
+	counts := make([]bool, maxCount+1)
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, err1 := strconv.Atoi(s[:i])
+		hi, err2 := strconv.Atoi(s[i+1:])
+		if err1 != nil || err2 != nil || lo > hi {
+			return nil, fmt.Errorf("invalid range %q", s)
+		}
+		for n := imax(lo, 0); n <= imin(hi, maxCount); n++ {
+			counts[n] = true
+		}
+		return counts, nil
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return nil, fmt.Errorf("invalid count %q", c)
+		}
+		if n := int(c - '0'); n <= maxCount {
+			counts[n] = true
+		}
+	}
+	return counts, nil
+}
+
+// Number of neighbours of a tile, excluding itself
+func (rule CARule) maxNeighbours() int {
+	if rule.Neighbourhood == NeighbourhoodVonNeumann {
+		return 2 * rule.Radius * (rule.Radius + 1)
+	}
+	return (2*rule.Radius+1)*(2*rule.Radius+1) - 1
+}
+
+func (rule CARule) apply(l *Layer, w *caWorkspace) {
+	if rule.Neighbourhood == NeighbourhoodMoore {
+		w.sat.update(l, roadTile)
+	}
+	for y := 0; y < l.Height; y++ {
+		for x := 0; x < l.Width; x++ {
+			i := x + y*l.Width
+			n := rule.countNeighbours(l, w, x, y)
+			alive := l.Tiles[i] == roadTile
+			if (alive && hasCount(rule.Survival, n)) ||
+				(!alive && hasCount(rule.Birth, n)) {
+				w.buf[i] = roadTile
+			} else {
+				w.buf[i] = floorTile
+			}
+		}
+	}
+	w.swap(l)
+}
+
+// Count stones in the rule's neighbourhood, excluding the tile itself
+// Boundary tiles count
+func (rule CARule) countNeighbours(l *Layer, w *caWorkspace, x, y int) int {
+	if rule.Neighbourhood == NeighbourhoodMoore {
+		c := w.sat.count(x, y, rule.Radius)
+		if l.getTile(x, y) == roadTile {
+			c--
+		}
+		return c
+	}
+	c := 0
+	for yi := y - rule.Radius; yi <= y+rule.Radius; yi++ {
+		dx := rule.Radius - Abs(yi-y)
+		for xi := x - dx; xi <= x+dx; xi++ {
+			if xi == x && yi == y {
+				continue
+			}
+			if !l.isIn(xi, yi) || l.getTile(xi, yi) == roadTile {
+				c++
+			}
+		}
+	}
+	return c
+}
+
+func hasCount(counts []bool, n int) bool {
+	return n >= 0 && n < len(counts) && counts[n]
 }
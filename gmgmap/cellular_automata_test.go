@@ -0,0 +1,101 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParseCARules(t *testing.T) {
+	rules, err := ParseCARules("B5678/S45678x4, b12-20/s10-24/N3, B3/S23/M2X0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("got %d rules, want 3", len(rules))
+	}
+	if r := rules[0]; r.Neighbourhood != NeighbourhoodMoore || r.Radius != 1 || r.Repeat != 4 ||
+		len(r.Birth) != 9 || r.Birth[4] || !r.Birth[5] || !r.Survival[4] || r.Survival[3] {
+		t.Errorf("4-5 rule: got %+v", r)
+	}
+	if r := rules[1]; r.Neighbourhood != NeighbourhoodVonNeumann || r.Radius != 3 ||
+		len(r.Birth) != 25 || r.Birth[11] || !r.Birth[12] || !r.Birth[20] || r.Birth[21] || !r.Survival[24] {
+		t.Errorf("von Neumann rule: got %+v", r)
+	}
+	if r := rules[2]; r.Radius != 2 || r.Repeat != 0 || len(r.Birth) != 25 {
+		t.Errorf("radius 2 rule: got %+v", r)
+	}
+
+	for _, s := range []string{
+		"",
+		"B3",
+		"B3/S23/M1/x",
+		"B3/B23",
+		"S23/S3",
+		"B3/",
+		"B3/S2a",
+		"B3/S5-2",
+		"B3/S23/Q1",
+		"B3/S23/",
+		"B3/S23/M0",
+		"B3/S23/Mx",
+		"B3/S23x",
+		"B3/S23x-1",
+		"B3/S23,",
+	} {
+		if _, err := ParseCARules(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestSummedAreaTableCount(t *testing.T) {
+	rr := rand.New(rand.NewSource(1))
+	for _, size := range []vec2{{1, 1}, {3, 7}, {20, 13}} {
+		l := NewMap(size.x, size.y).Layer("Structures")
+		fillRandom(rr, l, 45)
+		sat := newSummedAreaTable(l, 3)
+		sat.update(l, roadTile)
+		for y := 0; y < l.Height; y++ {
+			for x := 0; x < l.Width; x++ {
+				for r := 0; r <= 3; r++ {
+					if got, want := sat.count(x, y, r), l.countTiles(x, y, r, roadTile); got != want {
+						t.Errorf("%dx%d at %d,%d radius %d: got %d, want %d",
+							size.x, size.y, x, y, r, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Count the number of separate floor areas between the stones of a layer
+func countFloorAreas(l *Layer) int {
+	c := &Layer{"c", append([]rune{}, l.Tiles...), l.Width, l.Height}
+	for i, t := range c.Tiles {
+		if t != roadTile {
+			c.Tiles[i] = floor
+		}
+	}
+	n := 0
+	for i, t := range c.Tiles {
+		if t != roadTile && t >= 0 {
+			c.floodFill(i%c.Width, i/c.Width, -1)
+			n++
+		}
+	}
+	return n
+}
+
+func TestCellularAutomataConnected(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		for connect := ConnectChain; connect <= ConnectMST; connect++ {
+			for tunnel := TunnelStraight; tunnel <= TunnelOrganic; tunnel++ {
+				opts := CaveOptions{connect, tunnel, 15}
+				m := NewCellularAutomataWithOptions(rand.New(rand.NewSource(seed)), 60, 40, 45, 4, 5, 2, opts)
+				if n := countFloorAreas(m.Layer("Structures")); n != 1 {
+					t.Errorf("seed %d with %+v: %d floor areas, want 1", seed, opts, n)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// City road layouts
+const (
+	CityGrid = iota
+	CityOrganic
+)
+
+// Districts of a city
+const (
+	districtMarket = iota
+	districtResidential
+	districtCraft
+	districtNoble
+	districtSlum
+)
+
+type districtType struct {
+	name string
+	// Size of lots, and how far buildings are set back from their edges
+	lotMin, lotMax, setback int
+	// Percent chance for a lot to be built on, and for a block to be a park
+	density, parkChance int
+	// Importance of buildings
+	minImportance, maxImportance int
+	// Types of buildings, with repeats for the more common types
+	buildingTypes []int
+}
+
+var districtTypes = []districtType{
+	districtMarket: {"Market", 6, 9, 0, 90, 0, 4, 9,
+		[]int{buildingShop, buildingShop, buildingTavern, buildingHouse}},
+	districtResidential: {"Residential", 7, 10, 1, 75, 10, 2, 6,
+		[]int{buildingHouse, buildingHouse, buildingHouse, buildingShop, buildingTavern}},
+	districtCraft: {"Craft", 7, 11, 1, 80, 5, 3, 8,
+		[]int{buildingSmithy, buildingSmithy, buildingShop, buildingHouse}},
+	districtNoble: {"Noble", 9, 14, 2, 60, 25, 8, 14,
+		[]int{buildingHouse, buildingHouse, buildingTemple, buildingTownHall}},
+	districtSlum: {"Slum", 5, 7, 0, 95, 0, 1, 3,
+		[]int{buildingHouse}},
+}
+
+// A city block: an area enclosed by roads
+type cityBlock struct {
+	id     int
+	r      rect
+	area   int
+	centre vec2
+}
+
+// A lot within a block, and the side facing the road
+type cityLot struct {
+	r     rect
+	front int
+}
+
+// NewCity - create a city of districts laid out on a network of roads.
+// Major roads are laid out as a grid, or grown from the centre like an
+// L-system; the blocks between them are divided into lots facing the roads.
+// The city is divided into districts, which decide the size of lots, how
+// densely they're built on, and the types of buildings, from market shops to
+// slum houses and noble mansions.
+// The central block of the market district is a plaza with stalls and a
+// fountain, and some blocks are left as parks.
+// There is at least one district.
+// Districts, plazas, parks and buildings are recorded as map objects.
+func NewCity(rr *rand.Rand, exportFunc func(*Map), width, height, layout, numDistricts int, interiors bool) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	f := m.Layer("Furniture")
+
+	g.fill(grass)
+	exportFunc(m)
+
+	if layout == CityOrganic {
+		growCityRoads(rr, g)
+	} else {
+		addGridRoads(rr, g)
+	}
+	exportFunc(m)
+
+	// Districts; the one in the middle is the market
+	numDistricts = imax(numDistricts, 1)
+	v := newVoronoi(rr, width, height, numDistricts, 2)
+	districts := make([]int, len(v.sites))
+	market := v.region(width/2, height/2)
+	for i := range districts {
+		if i == market {
+			districts[i] = districtMarket
+		} else {
+			districts[i] = rr.Intn(len(districtTypes)-1) + 1
+		}
+		if _, area := v.bounds(i); area == 0 {
+			continue
+		}
+		o := v.addObject(m, i)
+		o.Name = fmt.Sprintf("District %d", i)
+		o.Type = "district"
+		o.Properties["district"] = districtTypes[districts[i]].name
+	}
+
+	blocks, blockOf := findCityBlocks(g)
+	used := make([]bool, width*height)
+	plazaBlock := -1
+	for _, b := range blocks {
+		if v.region(b.centre.x, b.centre.y) == market && blockOf[b.centre.x+b.centre.y*width] == b.id &&
+			(plazaBlock < 0 || manhattanDistance(b.centre.x, b.centre.y, width/2, height/2) <
+				manhattanDistance(blocks[plazaBlock].centre.x, blocks[plazaBlock].centre.y, width/2, height/2)) {
+			plazaBlock = b.id
+		}
+	}
+	if plazaBlock >= 0 {
+		addPlaza(rr, m, g, s, f, blocks[plazaBlock], blockOf, used)
+	}
+	exportFunc(m)
+
+	var buildings []building
+	var fronts []int
+	numParks := 0
+	hasTownHall := false
+	for _, b := range blocks {
+		dt := districtTypes[districts[v.region(b.centre.x, b.centre.y)]]
+		if b.id != plazaBlock && rr.Intn(100) < dt.parkChance {
+			numParks++
+			addPark(rr, m, g, s, f, b, blockOf, used, numParks)
+			continue
+		}
+		hasTemple := false
+		for _, lot := range cityLots(rr, g, blockOf, b, dt) {
+			if !isLotFree(used, width, lot.r) {
+				continue
+			}
+			r := rect{lot.r.x + dt.setback, lot.r.y + dt.setback,
+				lot.r.w - dt.setback*2, lot.r.h - dt.setback*2}
+			if rr.Intn(100) >= dt.density || r.w < 5 || r.h < 5 {
+				continue
+			}
+			markUsed(used, width, lot.r)
+			t := dt.buildingTypes[rr.Intn(len(dt.buildingTypes))]
+			if !buildingTypes[t].fits(r) || (t == buildingTownHall && hasTownHall) ||
+				(t == buildingTemple && hasTemple) {
+				t = buildingHouse
+			}
+			hasTownHall = hasTownHall || t == buildingTownHall
+			hasTemple = hasTemple || t == buildingTemple
+			importance := rr.Intn(dt.maxImportance-dt.minImportance+1) + dt.minImportance
+			buildings = append(buildings,
+				building{r, importance, t, newFootprint(FootprintRect, r), nil, lot.front})
+			fronts = append(fronts, lot.front)
+		}
+		// Trees on empty lots and the land left over
+		addTrees(rr, s, b, blockOf, used)
+		exportFunc(m)
+	}
+
+	assignBuildingShapes(rr, buildings)
+	var entered []building
+	for i := range buildings {
+		// Face the road in front of the lot, otherwise any other side
+		facings := []int{fronts[i]}
+		for _, facing := range []int{DirectionDown, DirectionRight, DirectionLeft, DirectionUp} {
+			if facing != fronts[i] {
+				facings = append(facings, facing)
+			}
+		}
+		if setDoors(buildings, i, rect{0, 0, width, height}, facings) {
+			entered = append(entered, buildings[i])
+		}
+	}
+	buildings = entered
+	placeBuildings(m, exportFunc, g, s, f, buildings)
+	if interiors {
+		addInteriors(rr, m, exportFunc, buildings)
+	}
+	addWalkways(g, s, buildings)
+	exportFunc(m)
+	addDecorations(rr, m, exportFunc, g, s, f, buildings)
+	c := m.Layer("Characters")
+	placeNPCs(rr, m, exportFunc, s, f, c, buildings)
+	addBuildingObjects(m, buildings)
+
+	return m
+}
+
+func isCityRoad(tile rune) bool {
+	return tile == road || tile == road2
+}
+
+// Lay out roads in a grid of blocks, with avenues through the middle and
+// every few streets
+func addGridRoads(rr *rand.Rand, g *Layer) {
+	xs := gridRoadPositions(rr, g.Width)
+	ys := gridRoadPositions(rr, g.Height)
+	for i, x := range xs {
+		tile, w := road, 1
+		if isAvenue(i, len(xs)) {
+			tile, w = road2, 2
+		}
+		g.rectangle(rect{x, 0, w, g.Height}, tile, true)
+	}
+	for i, y := range ys {
+		tile, h := road, 1
+		if isAvenue(i, len(ys)) {
+			tile, h = road2, 2
+		}
+		for x := 0; x < g.Width; x++ {
+			for dy := 0; dy < h; dy++ {
+				// Avenues take precedence where they cross streets
+				if tile == road2 || g.getTile(x, y+dy) != road2 {
+					g.setTile(x, y+dy, tile)
+				}
+			}
+		}
+	}
+}
+
+// Positions of roads along a length, a block apart
+func gridRoadPositions(rr *rand.Rand, length int) []int {
+	var positions []int
+	for p := rr.Intn(4) + 1; p < length-2; p += rr.Intn(7) + 12 {
+		positions = append(positions, p)
+	}
+	return positions
+}
+
+// Whether a grid road is an avenue: the middle one, and every third from it
+func isAvenue(i, n int) bool {
+	return Abs(i-n/2)%3 == 0
+}
+
+// Grow roads from the centre like an L-system: each road carries on
+// straight, and may branch left and right, until it runs into another road,
+// comes too close alongside one, or reaches the edge of the map.
+// Major roads are avenues, and mostly branch into minor streets.
+func growCityRoads(rr *rand.Rand, g *Layer) {
+	type segment struct {
+		start vec2
+		dir   int
+		major bool
+		depth int
+	}
+	centre := vec2{g.Width / 2, g.Height / 2}
+	var queue []segment
+	for dir := DirectionUp; dir <= DirectionLeft; dir++ {
+		queue = append(queue, segment{centre, dir, true, 0})
+	}
+	roads := newLayer("Roads", g.Width, g.Height)
+	roads.setTile(centre.x, centre.y, road2)
+	maxDepth := (g.Width + g.Height) / 10
+	for i := 0; len(queue) > 0 && i < g.Width*g.Height/20; i++ {
+		seg := queue[0]
+		queue = queue[1:]
+		tile, length := road, rr.Intn(5)+6
+		if seg.major {
+			tile, length = road2, rr.Intn(6)+8
+		}
+		end, ok := extendCityRoad(roads, seg.start, seg.dir, length, tile)
+		if !ok || seg.depth >= maxDepth {
+			continue
+		}
+		if rr.Intn(10) < 8 {
+			queue = append(queue, segment{end, seg.dir, seg.major, seg.depth + 1})
+		}
+		for _, turn := range []int{1, 3} {
+			if rr.Intn(2) == 0 {
+				dir := (seg.dir-DirectionUp+turn)%4 + DirectionUp
+				major := seg.major && rr.Intn(4) == 0
+				queue = append(queue, segment{end, dir, major, seg.depth + 1})
+			}
+		}
+	}
+	// Major roads are two tiles wide
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			switch roads.getTile(x, y) {
+			case road2:
+				g.rectangle(rect{x, y, 2, 2}, road2, true)
+			case road:
+				if g.getTile(x, y) != road2 {
+					g.setTile(x, y, road)
+				}
+			}
+		}
+	}
+}
+
+// Extend a road from a point in a direction, returning the end and whether
+// it can grow any further
+func extendCityRoad(roads *Layer, start vec2, dir, length int, tile rune) (vec2, bool) {
+	o := walkOffsets[dir-DirectionUp]
+	t := walkOffsets[dir%4]
+	p := start
+	for i := 0; i < length; i++ {
+		n := vec2{p.x + o.x, p.y + o.y}
+		if n.x < 1 || n.y < 1 || n.x >= roads.Width-2 || n.y >= roads.Height-2 {
+			return p, false
+		}
+		if isCityRoad(roads.getTile(n.x, n.y)) {
+			// Joined another road
+			return n, false
+		}
+		// Stop short of running alongside another road
+		for k := 1; k <= 5; k++ {
+			for _, side := range []int{k, -k} {
+				sx, sy := n.x+t.x*side, n.y+t.y*side
+				if isCityRoad(roads.getTile(sx, sy)) && isCityRoad(roads.getTile(sx-o.x, sy-o.y)) {
+					return p, false
+				}
+			}
+		}
+		roads.setTile(n.x, n.y, tile)
+		p = n
+	}
+	return p, true
+}
+
+// Find blocks: areas enclosed by roads. Returns the blocks, and which block
+// each tile is in, or -1 for roads.
+func findCityBlocks(g *Layer) ([]cityBlock, []int) {
+	blockOf := make([]int, g.Width*g.Height)
+	for i := range blockOf {
+		blockOf[i] = -1
+	}
+	var blocks []cityBlock
+	for i := range blockOf {
+		if blockOf[i] >= 0 || isCityRoad(g.Tiles[i]) {
+			continue
+		}
+		b := cityBlock{id: len(blocks)}
+		x1, y1, x2, y2 := g.Width, g.Height, -1, -1
+		sumX, sumY := 0, 0
+		blockOf[i] = b.id
+		frontier := []int{i}
+		for len(frontier) > 0 {
+			j := frontier[len(frontier)-1]
+			frontier = frontier[:len(frontier)-1]
+			x, y := j%g.Width, j/g.Width
+			x1, y1, x2, y2 = imin(x1, x), imin(y1, y), imax(x2, x), imax(y2, y)
+			sumX, sumY = sumX+x, sumY+y
+			b.area++
+			for _, d := range walkOffsets {
+				nx, ny := x+d.x, y+d.y
+				n := nx + ny*g.Width
+				if g.isIn(nx, ny) && blockOf[n] < 0 && !isCityRoad(g.Tiles[n]) {
+					blockOf[n] = b.id
+					frontier = append(frontier, n)
+				}
+			}
+		}
+		b.r = rect{x1, y1, x2 - x1 + 1, y2 - y1 + 1}
+		b.centre = vec2{sumX / b.area, sumY / b.area}
+		blocks = append(blocks, b)
+	}
+	return blocks, blockOf
+}
+
+// Divide a block into lots along its edges, each facing a road: lots are
+// placed in turn wherever one fits, shrinking them down to the district's
+// smallest size if need be
+func cityLots(rr *rand.Rand, g *Layer, blockOf []int, b cityBlock, dt districtType) []cityLot {
+	var lots []cityLot
+	for y := b.r.y; y < b.r.y+b.r.h; y++ {
+		for x := b.r.x; x < b.r.x+b.r.w; x++ {
+			if blockOf[x+y*g.Width] != b.id {
+				continue
+			}
+			for front := DirectionUp; front <= DirectionLeft; front++ {
+				o := walkOffsets[front-DirectionUp]
+				if !isCityRoad(g.getTile(x+o.x, y+o.y)) {
+					continue
+				}
+				if lot, ok := fitLot(rr, g, blockOf, b, dt, lots, vec2{x, y}, front); ok {
+					lots = append(lots, lot)
+				}
+			}
+		}
+	}
+	return lots
+}
+
+// Fit a lot with one corner of its front at a tile, running along the road
+// and back from it. The whole front must face the road, so that a door
+// anywhere along it opens onto the road.
+func fitLot(rr *rand.Rand, g *Layer, blockOf []int, b cityBlock, dt districtType, lots []cityLot, p vec2, front int) (cityLot, bool) {
+	o := walkOffsets[front-DirectionUp]
+	t := walkOffsets[front%4]
+	w0 := rr.Intn(dt.lotMax-dt.lotMin+1) + dt.lotMin
+	d0 := rr.Intn(dt.lotMax-dt.lotMin+1) + dt.lotMin
+	for w := w0; w >= dt.lotMin; w-- {
+		for d := d0; d >= dt.lotMin; d-- {
+			// Opposite corner: along the road, and away from it
+			q := vec2{p.x + t.x*(w-1) - o.x*(d-1), p.y + t.y*(w-1) - o.y*(d-1)}
+			r := rect{imin(p.x, q.x), imin(p.y, q.y), Abs(q.x-p.x) + 1, Abs(q.y-p.y) + 1}
+			if r.x < b.r.x || r.y < b.r.y || r.x+r.w > b.r.x+b.r.w || r.y+r.h > b.r.y+b.r.h ||
+				!isInBlock(blockOf, g.Width, r, b.id) || frontage(g, r, front) < w {
+				continue
+			}
+			overlaps := false
+			for _, lot := range lots {
+				overlaps = overlaps || lot.r.Overlaps(r)
+			}
+			if !overlaps {
+				return cityLot{r, front}, true
+			}
+		}
+	}
+	return cityLot{}, false
+}
+
+// Number of road tiles along one side of a lot
+func frontage(g *Layer, r rect, front int) int {
+	o := walkOffsets[front-DirectionUp]
+	count := 0
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if !r.isIn(x+o.x, y+o.y) && isCityRoad(g.getTile(x+o.x, y+o.y)) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func isInBlock(blockOf []int, width int, r rect, id int) bool {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if blockOf[x+y*width] != id {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isLotFree(used []bool, width int, r rect) bool {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if used[x+y*width] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func markUsed(used []bool, width int, r rect) {
+	for y := imax(r.y, 0); y < r.y+r.h && y < len(used)/width; y++ {
+		for x := imax(r.x, 0); x < r.x+r.w && x < width; x++ {
+			used[x+y*width] = true
+		}
+	}
+}
+
+// Plant trees on a third of the unused land in a block
+func addTrees(rr *rand.Rand, s *Layer, b cityBlock, blockOf []int, used []bool) {
+	for y := b.r.y; y < b.r.y+b.r.h; y++ {
+		for x := b.r.x; x < b.r.x+b.r.w; x++ {
+			i := x + y*s.Width
+			if blockOf[i] == b.id && !used[i] && s.getTile(x, y) == nothing && rr.Intn(3) == 0 {
+				s.setTile(x, y, tree)
+			}
+		}
+	}
+}
+
+// A plaza in the middle of a block: the largest area around its centre, up to
+// a size, paved as a market square with stalls and a fountain
+func addPlaza(rr *rand.Rand, m *Map, g, s, f *Layer, b cityBlock, blockOf []int, used []bool) {
+	plaza := rect{b.centre.x, b.centre.y, 1, 1}
+	for grown := true; grown; {
+		grown = false
+		for _, r := range []rect{
+			{plaza.x - 1, plaza.y, plaza.w + 1, plaza.h},
+			{plaza.x, plaza.y, plaza.w + 1, plaza.h},
+			{plaza.x, plaza.y - 1, plaza.w, plaza.h + 1},
+			{plaza.x, plaza.y, plaza.w, plaza.h + 1},
+		} {
+			if r.w <= 13 && r.h <= 9 && r.x >= 0 && r.y >= 0 && r.x+r.w <= g.Width &&
+				r.y+r.h <= g.Height && isInBlock(blockOf, g.Width, r, b.id) {
+				plaza = r
+				grown = true
+			}
+		}
+	}
+	if plaza.w < 5 || plaza.h < 5 {
+		return
+	}
+	// Keep lots a tile away from the plaza
+	markUsed(used, g.Width, rect{plaza.x - 1, plaza.y - 1, plaza.w + 2, plaza.h + 2})
+	fs := featureSites{g, s, f, newVillageWorld(plaza, s), plaza, nil, 0, map[vec2]bool{}, nil}
+	addMarket(rr, m, &fs, plaza)
+	m.AddObject("Plaza", "plaza", plaza.x, plaza.y, plaza.w, plaza.h, map[string]string{})
+}
+
+// A park over a whole block: trees scattered over the grass, with flower beds
+// and a fountain in the middle
+func addPark(rr *rand.Rand, m *Map, g, s, f *Layer, b cityBlock, blockOf []int, used []bool, n int) {
+	markUsed(used, g.Width, b.r)
+	if blockOf[b.centre.x+b.centre.y*g.Width] == b.id {
+		s.setTile(b.centre.x, b.centre.y, well)
+	}
+	for i := 0; i < b.area/30; i++ {
+		r := rect{b.r.x + rr.Intn(b.r.w), b.r.y + rr.Intn(b.r.h), 2, 2}
+		if r.x+r.w <= b.r.x+b.r.w && r.y+r.h <= b.r.y+b.r.h && isInBlock(blockOf, g.Width, r, b.id) &&
+			!s.hasTileIn(r, well) {
+			f.rectangle(r, flower, true)
+		}
+	}
+	for y := b.r.y; y < b.r.y+b.r.h; y++ {
+		for x := b.r.x; x < b.r.x+b.r.w; x++ {
+			if blockOf[x+y*g.Width] == b.id && s.getTile(x, y) == nothing &&
+				f.getTile(x, y) == nothing && rr.Intn(4) == 0 {
+				s.setTile(x, y, tree)
+			}
+		}
+	}
+	m.AddObject(fmt.Sprintf("Park %d", n), "park", b.r.x, b.r.y, b.r.w, b.r.h, map[string]string{})
+}
+
+// Pave walkways from doors to the nearest road, preferring to go straight
+// out from the door. Extra doors that can't reach a road are walled up.
+func addWalkways(g, s *Layer, buildings []building) {
+	canPave := func(p vec2) bool {
+		return g.isIn(p.x, p.y) && g.getTile(p.x, p.y) == grass &&
+			(s.getTile(p.x, p.y) == nothing || s.getTile(p.x, p.y) == tree)
+	}
+	for i := range buildings {
+		b := &buildings[i]
+		var doors []buildingDoor
+		for j, d := range b.doors {
+			if addWalkway(g, s, d, canPave) || j == 0 {
+				doors = append(doors, d)
+			} else {
+				_, tileWall := b.tiles()
+				s.setTile(d.x, d.y, tileWall)
+			}
+		}
+		b.doors = doors
+	}
+}
+
+// Pave a walkway from a door to the nearest road, returning whether the door
+// can reach a road
+func addWalkway(g, s *Layer, d buildingDoor, canPave func(vec2) bool) bool {
+	start := d.outside()
+	if !g.isIn(start.x, start.y) || isCityRoad(g.getTile(start.x, start.y)) {
+		return true
+	} else if !canPave(start) {
+		return false
+	}
+	offsets := []vec2{walkOffsets[d.facing-DirectionUp]}
+	for _, o := range walkOffsets {
+		if o != offsets[0] {
+			offsets = append(offsets, o)
+		}
+	}
+	prev := map[vec2]vec2{start: start}
+	frontier := []vec2{start}
+	for len(frontier) > 0 {
+		p := frontier[0]
+		frontier = frontier[1:]
+		if isCityRoad(g.getTile(p.x, p.y)) {
+			for p = prev[p]; p != start; p = prev[p] {
+				g.setTile(p.x, p.y, road)
+				s.setTile(p.x, p.y, nothing)
+			}
+			g.setTile(start.x, start.y, road)
+			s.setTile(start.x, start.y, nothing)
+			return true
+		}
+		for _, o := range offsets {
+			n := vec2{p.x + o.x, p.y + o.y}
+			if _, ok := prev[n]; ok || !g.isIn(n.x, n.y) ||
+				(!canPave(n) && !isCityRoad(g.getTile(n.x, n.y))) {
+				continue
+			}
+			prev[n] = p
+			frontier = append(frontier, n)
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNewCityDoorsTouchRoads(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		for layout := CityGrid; layout <= CityOrganic; layout++ {
+			rr := rand.New(rand.NewSource(seed))
+			m := NewCity(rr, func(*Map) {}, 80, 50, layout, int(seed%6), seed%2 == 0)
+			g := m.Layer("Ground")
+			s := m.Layer("Structures")
+			doors := 0
+			for i, tile := range s.Tiles {
+				if tile != door {
+					continue
+				}
+				doors++
+				// Doors that lead outside must open onto a road
+				x, y := i%m.Width, i/m.Width
+				road, outside := false, false
+				for _, o := range walkOffsets {
+					ground, structure := g.getTile(x+o.x, y+o.y), s.getTile(x+o.x, y+o.y)
+					if isCityRoad(ground) {
+						road = true
+					} else if ground == grass && !IsWall(structure) {
+						outside = true
+					}
+				}
+				if outside && !road {
+					t.Errorf("seed %d layout %d: door at %d,%d doesn't touch a road", seed, layout, x, y)
+				}
+			}
+			if doors == 0 {
+				t.Errorf("seed %d layout %d: no doors", seed, layout)
+			}
+		}
+	}
+}
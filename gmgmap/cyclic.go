@@ -0,0 +1,301 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+// Cyclic dungeon edge types
+const (
+	cycleEdgeNormal = iota
+	cycleEdgeLocked
+	cycleEdgeShortcut
+	cycleEdgeSecret
+)
+
+var cycleEdgeNames = []string{"door", "locked", "shortcut", "secret"}
+
+// Rooms need at least 4 tiles including walls, and a gap to the cell edges
+const minCycleCellSize = 6
+
+type cycleNode struct {
+	cell vec2
+	role string
+	room rect
+}
+
+// An edge between two nodes; shortcuts are one-way, from a to b
+type cycleEdge struct {
+	a, b     int
+	edgeType int
+}
+
+// A graph of rooms on a grid, where edges connect adjacent grid cells
+type cycleGraph struct {
+	gridWidth  int
+	gridHeight int
+	nodes      []cycleNode
+	edges      []cycleEdge
+	cells      []int
+}
+
+// NewCyclic - create a dungeon built around cycles.
+// Start with a loop of rooms on a grid between the entrance and the goal,
+// either two alternative paths, or one path with a one-way shortcut back from
+// the goal. Then repeatedly pick an ordinary connection and insert a
+// sub-cycle beside it. Each sub-cycle is one of:
+// - lock and key: the old connection is locked, with the key in the new loop,
+// which is entered from the near side of the lock. The loop's other end is a
+// one-way door from the far side of the lock back into the key room. Only
+// connections with no other way around them are locked; otherwise this is a
+// shortcut instead.
+// - shortcut: a one-way door back from the new loop
+// - hidden return path: a secret door back from the new loop
+// The graph is then realised as rooms in grid cells, connected by corridors.
+// The grid is made coarser if its cells are too small for rooms; maps too
+// small for a loop of rooms are left empty.
+// Rooms and special doors are recorded as map objects.
+func NewCyclic(rr *rand.Rand, exportFunc func(*Map), width, height, gridWidth, gridHeight, numCycles int) *Map {
+	m := NewMap(width, height)
+	gridWidth = imin(gridWidth, width/minCycleCellSize)
+	gridHeight = imin(gridHeight, height/minCycleCellSize)
+	if gridWidth < 2 || gridHeight < 2 {
+		return m
+	}
+	gr := newCycleGraph(rr, gridWidth, gridHeight)
+	for i := 0; i < numCycles; i++ {
+		// Try a few times to find space for the sub-cycle
+		for j := 0; j < 20; j++ {
+			if gr.insertCycle(rr) {
+				break
+			}
+		}
+	}
+	gr.realise(rr, m, exportFunc)
+	return m
+}
+
+// Start with a main loop around a rectangle of grid cells
+func newCycleGraph(rr *rand.Rand, gridWidth, gridHeight int) *cycleGraph {
+	gr := &cycleGraph{gridWidth, gridHeight, nil, nil, make([]int, gridWidth*gridHeight)}
+	for i := range gr.cells {
+		gr.cells[i] = -1
+	}
+	w := rr.Intn(gridWidth-1) + 2
+	h := rr.Intn(gridHeight-1) + 2
+	x0 := rr.Intn(gridWidth - w + 1)
+	y0 := rr.Intn(gridHeight - h + 1)
+	var loop []vec2
+	for x := x0; x < x0+w; x++ {
+		loop = append(loop, vec2{x, y0})
+	}
+	for y := y0 + 1; y < y0+h; y++ {
+		loop = append(loop, vec2{x0 + w - 1, y})
+	}
+	for x := x0 + w - 2; x >= x0; x-- {
+		loop = append(loop, vec2{x, y0 + h - 1})
+	}
+	for y := y0 + h - 2; y > y0; y-- {
+		loop = append(loop, vec2{x0, y})
+	}
+	for i, cell := range loop {
+		gr.addNode(cell)
+		if i > 0 {
+			gr.edges = append(gr.edges, cycleEdge{i - 1, i, cycleEdgeNormal})
+		}
+	}
+	gr.edges = append(gr.edges, cycleEdge{len(loop) - 1, 0, cycleEdgeNormal})
+	// Entrance and goal on opposite sides of the loop
+	entrance := rr.Intn(len(loop))
+	goal := (entrance + len(loop)/2) % len(loop)
+	gr.nodes[entrance].role = "entrance"
+	gr.nodes[goal].role = "goal"
+	if rr.Intn(2) == 0 {
+		// The edge leaving the goal is the one from goal to goal+1
+		gr.edges[goal].edgeType = cycleEdgeShortcut
+	}
+	return gr
+}
+
+func (gr *cycleGraph) addNode(cell vec2) int {
+	gr.nodes = append(gr.nodes, cycleNode{cell, "", rect{}})
+	gr.cells[cell.x+cell.y*gr.gridWidth] = len(gr.nodes) - 1
+	return len(gr.nodes) - 1
+}
+
+func (gr *cycleGraph) isFree(cell vec2) bool {
+	return cell.x >= 0 && cell.y >= 0 && cell.x < gr.gridWidth &&
+		cell.y < gr.gridHeight && gr.cells[cell.x+cell.y*gr.gridWidth] < 0
+}
+
+// Nodes that can be reached from the entrance without using an edge (-1 for
+// none), going through shortcuts only in their direction
+func (gr *cycleGraph) reachable(without int) []bool {
+	reached := make([]bool, len(gr.nodes))
+	var frontier []int
+	for i, n := range gr.nodes {
+		if n.role == "entrance" {
+			reached[i] = true
+			frontier = append(frontier, i)
+		}
+	}
+	for len(frontier) > 0 {
+		n := frontier[len(frontier)-1]
+		frontier = frontier[:len(frontier)-1]
+		for i, e := range gr.edges {
+			if i == without {
+				continue
+			}
+			for _, next := range []int{e.a, e.b} {
+				if (e.a == n || (e.b == n && e.edgeType != cycleEdgeShortcut)) && !reached[next] {
+					reached[next] = true
+					frontier = append(frontier, next)
+				}
+			}
+		}
+	}
+	return reached
+}
+
+// Insert a sub-cycle beside a random ordinary edge a-b, via two new nodes
+// c-d, which together form a square of grid cells.
+// Sub-cycles are never inserted beside special edges, as they would be a way
+// around them.
+func (gr *cycleGraph) insertCycle(rr *rand.Rand) bool {
+	e := rr.Intn(len(gr.edges))
+	edge := gr.edges[e]
+	if edge.edgeType != cycleEdgeNormal {
+		return false
+	}
+	a, b := gr.nodes[edge.a].cell, gr.nodes[edge.b].cell
+	// Perpendicular to the edge, either side
+	p := vec2{b.y - a.y, a.x - b.x}
+	if rr.Intn(2) == 0 {
+		p = vec2{-p.x, -p.y}
+	}
+	c, d := vec2{a.x + p.x, a.y + p.y}, vec2{b.x + p.x, b.y + p.y}
+	if !gr.isFree(c) || !gr.isFree(d) {
+		return false
+	}
+	// Which side of the edge can be reached without it, before the new loop
+	// goes around it
+	reached := gr.reachable(e)
+	ci, di := gr.addNode(c), gr.addNode(d)
+	gr.edges = append(gr.edges,
+		cycleEdge{edge.a, ci, cycleEdgeNormal},
+		cycleEdge{ci, di, cycleEdgeNormal},
+		cycleEdge{di, edge.b, cycleEdgeNormal})
+	there, back := len(gr.edges)-3, len(gr.edges)-1
+	switch rr.Intn(3) {
+	case 0:
+		if reached[edge.a] != reached[edge.b] {
+			// Lock the edge, with the key at the far end of the new loop from
+			// the near side, and a one-way door into the key room from the far
+			// side of the lock
+			gr.edges[e].edgeType = cycleEdgeLocked
+			if reached[edge.a] {
+				gr.edges[back] = cycleEdge{edge.b, di, cycleEdgeShortcut}
+				gr.nodes[di].role = "key"
+			} else {
+				gr.edges[there] = cycleEdge{edge.a, ci, cycleEdgeShortcut}
+				gr.nodes[ci].role = "key"
+			}
+			break
+		}
+		// There's a way around the edge, so a lock would be pointless
+		gr.edges[back].edgeType = cycleEdgeShortcut
+	case 1:
+		gr.edges[back].edgeType = cycleEdgeShortcut
+	case 2:
+		gr.edges[back].edgeType = cycleEdgeSecret
+	}
+	return true
+}
+
+func (gr *cycleGraph) realise(rr *rand.Rand, m *Map, exportFunc func(*Map)) {
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	c := m.Layer("Characters")
+	cellWidth, cellHeight := m.Width/gr.gridWidth, m.Height/gr.gridHeight
+
+	// Rooms, leaving a gap to the cell edges so corridors can pass
+	for i := range gr.nodes {
+		n := &gr.nodes[i]
+		w := rr.Intn(imax(cellWidth-5, 1)) + 4
+		h := rr.Intn(imax(cellHeight-5, 1)) + 4
+		n.room = rect{n.cell.x*cellWidth + 1 + rr.Intn(imax(cellWidth-w-1, 1)),
+			n.cell.y*cellHeight + 1 + rr.Intn(imax(cellHeight-h-1, 1)), w, h}
+		s.rectangleUnfilled(n.room, wall2)
+		g.rectangleFilled(rect{n.room.x + 1, n.room.y + 1, n.room.w - 2, n.room.h - 2}, room)
+	}
+	exportFunc(m)
+
+	// Corridors with doors at either end
+	for _, e := range gr.edges {
+		a, b := gr.nodes[e.a], gr.nodes[e.b]
+		var x1, y1, x2, y2 int
+		switch {
+		case b.cell.x > a.cell.x:
+			x1, y1 = a.room.x+a.room.w-1, a.room.y+a.room.h/2
+			x2, y2 = b.room.x, b.room.y+b.room.h/2
+		case b.cell.x < a.cell.x:
+			x1, y1 = a.room.x, a.room.y+a.room.h/2
+			x2, y2 = b.room.x+b.room.w-1, b.room.y+b.room.h/2
+		case b.cell.y > a.cell.y:
+			x1, y1 = a.room.x+a.room.w/2, a.room.y+a.room.h-1
+			x2, y2 = b.room.x+b.room.w/2, b.room.y
+		default:
+			x1, y1 = a.room.x+a.room.w/2, a.room.y
+			x2, y2 = b.room.x+b.room.w/2, b.room.y+b.room.h-1
+		}
+		// Dig from outside the doors, so corridors don't run along room walls
+		ox, oy := iclamp(b.cell.x-a.cell.x, -1, 1), iclamp(b.cell.y-a.cell.y, -1, 1)
+		addCorridor(g, s, x1+ox, y1+oy, x2-ox, y2-oy, room2)
+		g.setTile(x1, y1, room2)
+		g.setTile(x2, y2, room2)
+		// Special doors are on the side of b, which one-way doors lead into
+		s.setTile(x1, y1, door)
+		switch e.edgeType {
+		case cycleEdgeLocked:
+			s.setTile(x2, y2, doorLocked)
+		case cycleEdgeShortcut:
+			s.setTile(x2, y2, doorOneWay)
+		case cycleEdgeSecret:
+			s.setTile(x2, y2, doorSecret)
+		default:
+			s.setTile(x2, y2, door)
+		}
+		if e.edgeType != cycleEdgeNormal {
+			o := m.AddObject(fmt.Sprintf("Door %d-%d", e.a, e.b), cycleEdgeNames[e.edgeType],
+				x2, y2, 1, 1, map[string]string{
+					"from": strconv.Itoa(e.a),
+					"to":   strconv.Itoa(e.b),
+				})
+			if e.edgeType == cycleEdgeShortcut {
+				for dir, offset := range walkOffsets {
+					if offset == (vec2{ox, oy}) {
+						o.Properties["direction"] = doorDirections[dir]
+					}
+				}
+			}
+		}
+	}
+	exportFunc(m)
+
+	for i, n := range gr.nodes {
+		inner := rect{n.room.x + 1, n.room.y + 1, n.room.w - 2, n.room.h - 2}
+		switch n.role {
+		case "entrance":
+			s.setTile(inner.x+inner.w/2, inner.y+inner.h/2, stairsUp)
+			c.setTileInAreaIfEmpty(rr, inner, player)
+		case "goal":
+			s.setTile(inner.x+inner.w/2, inner.y+inner.h/2, stairsDown)
+		case "key":
+			c.setTileInAreaIfEmpty(rr, inner, key)
+		}
+		m.AddObject(fmt.Sprintf("Room %d", i), "room",
+			n.room.x, n.room.y, n.room.w, n.room.h, map[string]string{"role": n.role})
+	}
+	exportFunc(m)
+}
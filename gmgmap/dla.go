@@ -0,0 +1,134 @@
+package gmgmap
+
+import "math/rand"
+
+// DLA seeding types
+const (
+	DLASeedCentre = iota
+	DLASeedBottom
+)
+
+// DLA particle spawn types
+const (
+	DLASpawnEdge = iota
+	DLASpawnRandom
+)
+
+// NewDLA - create a cave using diffusion-limited aggregation.
+// Starting from a seed, particles spawn at the map edges or random points and
+// walk randomly until they stick to the growing cave, until the cave covers
+// fillPct of the map.
+// The seed is either a point in the centre, or the whole bottom row, which
+// grows caves upwards like stalagmites.
+// With bias (0-100), particles tend to walk towards the seed, which makes the
+// cave denser and faster to generate, otherwise caves are thin and branching.
+func NewDLA(rr *rand.Rand, exportFunc func(*Map), width, height, seeding, spawn, bias, fillPct int) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	g.fill(floorTile)
+	s := m.Layer("Structures")
+	s.fill(roadTile)
+
+	// Keep a border of rock around the cave
+	inner := rect{1, 1, width - 2, height - 2}
+	if inner.w < 1 || inner.h < 1 {
+		return m
+	}
+	numFloor := 0
+	carve := func(x, y int) {
+		if s.getTile(x, y) != floorTile {
+			s.setTile(x, y, floorTile)
+			numFloor++
+		}
+	}
+	switch seeding {
+	case DLASeedCentre:
+		carve(width/2, height/2)
+	case DLASeedBottom:
+		for x := inner.x; x < inner.x+inner.w; x++ {
+			carve(x, inner.y+inner.h-1)
+		}
+	}
+	exportFunc(m)
+
+	target := fillPct * inner.w * inner.h / 100
+	exportInterval := imax(target/20, 1)
+	maxSteps := width * height * 4
+	// Give up if particles keep failing to stick, e.g. if there's nowhere left
+	// to spawn
+	failures := 0
+	for numFloor < target && failures < width*height {
+		failures++
+		x, y := dlaSpawn(rr, inner, spawn)
+		if s.getTile(x, y) == floorTile {
+			continue
+		}
+		for i := 0; i < maxSteps; i++ {
+			if dlaSticks(s, x, y) {
+				carve(x, y)
+				failures = 0
+				if numFloor%exportInterval == 0 {
+					exportFunc(m)
+				}
+				break
+			}
+			if rr.Intn(100) < bias {
+				x, y = dlaStepToSeed(x, y, width/2, height/2, seeding)
+			} else {
+				x, y = randomWalk(rr, x-inner.x, y-inner.y, inner.w, inner.h)
+				x, y = x+inner.x, y+inner.y
+			}
+		}
+	}
+
+	return m
+}
+
+// Spawn a particle, either on the edge of an area or anywhere in it
+func dlaSpawn(rr *rand.Rand, r rect, spawn int) (int, int) {
+	x, y := r.x+rr.Intn(r.w), r.y+rr.Intn(r.h)
+	if spawn == DLASpawnEdge {
+		switch rr.Intn(4) {
+		case 0:
+			y = r.y
+		case 1:
+			x = r.x + r.w - 1
+		case 2:
+			y = r.y + r.h - 1
+		case 3:
+			x = r.x
+		}
+	}
+	return x, y
+}
+
+// Whether a particle is next to the cave
+func dlaSticks(s *Layer, x, y int) bool {
+	for _, d := range []vec2{{0, -1}, {1, 0}, {0, 1}, {-1, 0}} {
+		if s.isIn(x+d.x, y+d.y) && s.getTile(x+d.x, y+d.y) == floorTile {
+			return true
+		}
+	}
+	return false
+}
+
+// Move a particle one step towards the seed; downwards for bottom seeding
+func dlaStepToSeed(x, y, cx, cy, seeding int) (int, int) {
+	if seeding == DLASeedBottom {
+		return x, y + 1
+	}
+	dx, dy := cx-x, cy-y
+	if Abs(dx) > Abs(dy) {
+		if dx > 0 {
+			return x + 1, y
+		}
+		return x - 1, y
+	}
+	if dy > 0 {
+		return x, y + 1
+	}
+	if dy < 0 {
+		return x, y - 1
+	}
+	return x, y
+}
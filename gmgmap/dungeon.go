@@ -0,0 +1,279 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+)
+
+// Dungeon - levels of maps linked by stairs
+type Dungeon struct {
+	Levels []*Map
+	Names  []string
+	Links  []StairLink
+}
+
+// StairLink - the stairs down on a level, and the stairs up on the next
+// level that they lead to
+type StairLink struct {
+	Level int
+	X, Y  int
+	ToX   int
+	ToY   int
+}
+
+// Aligned - whether the stairs are in the same position on both levels
+func (l StairLink) Aligned() bool {
+	return l.X == l.ToX && l.Y == l.ToY
+}
+
+// ScaleByDepth - scale a parameter by a percentage per level of depth
+func ScaleByDepth(base, pctPerLevel, depth int) int {
+	return base + base*pctPerLevel*depth/100
+}
+
+// Attempts at generating a level with stairs, before the dungeon ends early
+const maxLevelTries = 10
+
+// NewDungeon - create a dungeon of numLevels levels, using newLevel to
+// generate each level at each depth, so that any algorithm can be used and
+// its parameters can be scaled by depth.
+// Stairs up are placed where the stairs down were on the level above, if
+// that's a walkable tile; otherwise the stairs are linked explicitly.
+// Levels without stairs get them placed randomly, and levels without room
+// for stairs are generated again; if that keeps failing, the dungeon ends at
+// the last level with stairs down.
+// All stairs down on a level, such as extra ones from prefabs, lead to the
+// stairs up on the next level; extra stairs down on the last level are
+// removed.
+// Each level records its stairs as map objects, with the linked positions.
+func NewDungeon(rr *rand.Rand, numLevels int, newLevel func(depth int) *Map) *Dungeon {
+	d := &Dungeon{}
+	for depth := 0; depth < numLevels; depth++ {
+		var m *Map
+		ux, uy := -1, -1
+		for try := 0; try < maxLevelTries && m == nil; try++ {
+			m = newLevel(depth)
+			ux, uy = addStairs(rr, m, d, depth, numLevels)
+			if ux < 0 {
+				m = nil
+			}
+		}
+		if m == nil {
+			// The level above is the last, so its stairs lead nowhere
+			if depth > 0 {
+				removeTiles(d.Levels[depth-1], stairsDown)
+			}
+			break
+		}
+		d.addLevel(m, fmt.Sprintf("Level %d", depth))
+		if depth > 0 {
+			for _, down := range findTiles(d.Levels[depth-1], stairsDown) {
+				d.link(depth-1, down.x, down.y, ux, uy)
+			}
+		}
+	}
+	return d
+}
+
+// Add stairs up and down to a new level, lining up the stairs up with the
+// stairs down on the level above.
+// Returns the position of the stairs up, or -1, -1 if there isn't room for
+// the stairs.
+func addStairs(rr *rand.Rand, m *Map, d *Dungeon, depth, numLevels int) (int, int) {
+	s := m.Layer("Structures")
+	ux, uy := findTile(m, stairsUp)
+	if depth > 0 {
+		x, y := findTile(d.Levels[depth-1], stairsDown)
+		spots := stairSpots(m)
+		if m.Layer("Ground").isIn(x, y) && spots[x+y*m.Width] {
+			// Move the stairs up to line up with the stairs down
+			if ux >= 0 {
+				s.setTile(ux, uy, s.getTile(x, y))
+			}
+			ux, uy = x, y
+			s.setTile(ux, uy, stairsUp)
+		}
+	}
+	if ux < 0 {
+		ux, uy = placeStairs(rr, m, stairsUp)
+	}
+	if depth < numLevels-1 {
+		if x, _ := findTile(m, stairsDown); x < 0 {
+			if x, _ = placeStairs(rr, m, stairsDown); x < 0 {
+				return -1, -1
+			}
+		}
+	} else {
+		removeTiles(m, stairsDown)
+	}
+	return ux, uy
+}
+
+func (d *Dungeon) addLevel(m *Map, name string) {
+	d.Levels = append(d.Levels, m)
+	d.Names = append(d.Names, name)
+}
+
+// Link the stairs down on a level to the stairs up on the next level, and
+// record the stairs as map objects
+func (d *Dungeon) link(level, x, y, toX, toY int) {
+	d.Links = append(d.Links, StairLink{level, x, y, toX, toY})
+	d.Levels[level].AddObject("Stairs down", "stairs", x, y, 1, 1, map[string]string{
+		"level": d.Names[level+1], "x": strconv.Itoa(toX), "y": strconv.Itoa(toY),
+	})
+	d.Levels[level+1].AddObject("Stairs up", "stairs", toX, toY, 1, 1, map[string]string{
+		"level": d.Names[level], "x": strconv.Itoa(x), "y": strconv.Itoa(y),
+	})
+}
+
+// Find the position of a tile on any layer, or -1, -1
+func findTile(m *Map, tile rune) (int, int) {
+	if positions := findTiles(m, tile); len(positions) > 0 {
+		return positions[0].x, positions[0].y
+	}
+	return -1, -1
+}
+
+// Find the positions of a tile on all layers
+func findTiles(m *Map, tile rune) []vec2 {
+	var positions []vec2
+	for _, l := range m.Layers {
+		for i, t := range l.Tiles {
+			if t == tile {
+				positions = append(positions, vec2{i % m.Width, i / m.Width})
+			}
+		}
+	}
+	return positions
+}
+
+// Remove a tile from all layers
+func removeTiles(m *Map, tile rune) {
+	for _, l := range m.Layers {
+		for i, t := range l.Tiles {
+			if t == tile {
+				l.Tiles[i] = nothing
+			}
+		}
+	}
+}
+
+// Tiles where stairs can go: empty walkable tiles, connected to the existing
+// stairs (through any doors), or to the largest area if there are no stairs
+func stairSpots(m *Map) []bool {
+	ag := newAreaGraph(m)
+	spots := make([]bool, m.Width*m.Height)
+	if ag.numAreas == 0 {
+		return spots
+	}
+	anchor := ag.findArea(m, stairsUp)
+	if anchor < 0 {
+		anchor = ag.findArea(m, stairsDown)
+	}
+	if anchor < 0 {
+		sizes := make([]int, ag.numAreas)
+		anchor = 0
+		for _, area := range ag.areas {
+			if area >= 0 {
+				sizes[area]++
+				if sizes[area] > sizes[anchor] {
+					anchor = area
+				}
+			}
+		}
+	}
+	reachable, _ := ag.search(anchor, func(int) bool { return true })
+	s := m.Layer("Structures")
+	for i, area := range ag.areas {
+		if area < 0 || reachable[area] < 0 || (s.Tiles[i] != nothing && s.Tiles[i] != floorTile) {
+			continue
+		}
+		spots[i] = true
+		for _, l := range m.Layers {
+			if l.Name != "Ground" && l.Name != "Structures" && l.Tiles[i] != nothing {
+				spots[i] = false
+			}
+		}
+	}
+	return spots
+}
+
+// Place stairs on a random free tile, returning its position or -1, -1
+func placeStairs(rr *rand.Rand, m *Map, tile rune) (int, int) {
+	var tiles []int
+	for i, ok := range stairSpots(m) {
+		if ok {
+			tiles = append(tiles, i)
+		}
+	}
+	if len(tiles) == 0 {
+		return -1, -1
+	}
+	i := tiles[rr.Intn(len(tiles))]
+	m.Layer("Structures").Tiles[i] = tile
+	return i % m.Width, i / m.Width
+}
+
+// PrintLinks - print the table of stairs linking the levels
+func (d Dungeon) PrintLinks() {
+	for _, l := range d.Links {
+		aligned := ""
+		if l.Aligned() {
+			aligned = " (aligned)"
+		}
+		fmt.Printf("%s %d,%d -> %s %d,%d%s\n",
+			d.Names[l.Level], l.X, l.Y, d.Names[l.Level+1], l.ToX, l.ToY, aligned)
+	}
+}
+
+// ToTMX - export each level as a TMX file, and the stair links as CSV
+func (d Dungeon) ToTMX(rr *rand.Rand, tmxTemplate *TMXTemplate) error {
+	for i, m := range d.Levels {
+		if err := m.toTMX(rr, tmxTemplate, -1, fmt.Sprintf("level%02d.tmx", i)); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(path.Join(tmxExportDir, "links.csv"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(f, "level,x,y,toLevel,toX,toY")
+	for _, l := range d.Links {
+		fmt.Fprintf(f, "%d,%d,%d,%d,%d,%d\n", l.Level, l.X, l.Y, l.Level+1, l.ToX, l.ToY)
+	}
+	return f.Close()
+}
+
+// ToLayeredTMX - export all levels as one TMX file, with a group of layers
+// per level; only the first level is visible.
+// Objects from all levels are exported together, with their level's name.
+// All levels must be the same size.
+func (d Dungeon) ToLayeredTMX(rr *rand.Rand, tmxTemplate *TMXTemplate) error {
+	var groups []groupExport
+	var objects []objectExport
+	for i, m := range d.Levels {
+		if m.Width != d.Levels[0].Width || m.Height != d.Levels[0].Height {
+			return fmt.Errorf("%s is %dx%d, but %s is %dx%d", d.Names[i], m.Width, m.Height,
+				d.Names[0], d.Levels[0].Width, d.Levels[0].Height)
+		}
+		tmxTemplate.CSVs = make([]csvExport, 0)
+		tmxTemplate.Objects = make([]objectExport, 0)
+		populateTemplate(rr, *m, tmxTemplate)
+		groups = append(groups, groupExport{d.Names[i], i > 0, tmxTemplate.CSVs})
+		for _, o := range tmxTemplate.Objects {
+			o.ID = len(objects) + 1
+			o.Name = d.Names[i] + " " + o.Name
+			objects = append(objects, o)
+		}
+	}
+	if len(d.Levels) > 0 {
+		tmxTemplate.Width, tmxTemplate.Height = d.Levels[0].Width, d.Levels[0].Height
+	}
+	tmxTemplate.CSVs = make([]csvExport, 0)
+	tmxTemplate.Objects = objects
+	tmxTemplate.Groups = groups
+	return exportTMX(tmxTemplate, -1, "levels.tmx")
+}
@@ -0,0 +1,64 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNewDungeonStairLinks(t *testing.T) {
+	for seed := int64(0); seed < 10; seed++ {
+		rr := rand.New(rand.NewSource(seed))
+		d := NewDungeon(rr, 4, func(depth int) *Map {
+			return NewBSP(rr, 40, 30, 4, 5, 2)
+		})
+		if len(d.Levels) != 4 {
+			t.Fatalf("seed %d: %d levels, want 4", seed, len(d.Levels))
+		}
+		numDown := 0
+		for level, m := range d.Levels {
+			if n := len(findTiles(m, stairsUp)); n != 1 {
+				t.Errorf("seed %d level %d: %d stairs up, want 1", seed, level, n)
+			}
+			down := len(findTiles(m, stairsDown))
+			if level == len(d.Levels)-1 && down > 0 {
+				t.Errorf("seed %d: stairs down on the last level", seed)
+			} else if level < len(d.Levels)-1 && down == 0 {
+				t.Errorf("seed %d level %d: no stairs down", seed, level)
+			}
+			numDown += down
+		}
+		if len(d.Links) != numDown {
+			t.Errorf("seed %d: %d links for %d stairs down", seed, len(d.Links), numDown)
+		}
+		for _, link := range d.Links {
+			if tile := d.Levels[link.Level].Layer("Structures").getTile(link.X, link.Y); tile != stairsDown {
+				t.Errorf("seed %d: link %+v from %q, want stairs down", seed, link, tile)
+			}
+			if tile := d.Levels[link.Level+1].Layer("Structures").getTile(link.ToX, link.ToY); tile != stairsUp {
+				t.Errorf("seed %d: link %+v to %q, want stairs up", seed, link, tile)
+			}
+		}
+	}
+}
+
+func TestNewDungeonEndsEarly(t *testing.T) {
+	rr := rand.New(rand.NewSource(1))
+	d := NewDungeon(rr, 4, func(depth int) *Map {
+		if depth >= 2 {
+			// No room for stairs
+			return NewMap(10, 10)
+		}
+		return NewBSP(rr, 40, 30, 4, 5, 2)
+	})
+	if len(d.Levels) != 2 {
+		t.Fatalf("%d levels, want 2", len(d.Levels))
+	}
+	if x, _ := findTile(d.Levels[1], stairsDown); x >= 0 {
+		t.Error("stairs down on the last level")
+	}
+	for _, link := range d.Links {
+		if link.Level >= 1 {
+			t.Errorf("link %+v from the last level", link)
+		}
+	}
+}
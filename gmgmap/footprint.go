@@ -0,0 +1,194 @@
+package gmgmap
+
+import "math/rand"
+
+// Footprint shapes
+const (
+	FootprintRect = iota
+	FootprintL
+	FootprintT
+	FootprintU
+	FootprintCourtyard
+	FootprintCross
+)
+
+// Masks of which grid cells are inside each footprint shape, top row first.
+// Bottom middle is always inside, so entrances can go there.
+var footprintMasks = [][]string{
+	FootprintRect:      {"X"},
+	FootprintL:         {"X.", "XX"},
+	FootprintT:         {"XXX", ".X."},
+	FootprintU:         {"X.X", "XXX"},
+	FootprintCourtyard: {"XXX", "X.X", "XXX"},
+	FootprintCross:     {".X.", "XXX", ".X."},
+}
+
+// Minimum size of a footprint cell, so it can hold a wall, floor and wall
+const footprintMinCell = 3
+
+// A building footprint: a union of rects, made from cells of a grid that
+// covers the bounds. Like BSP rooms, the cells don't overlap.
+type footprint struct {
+	shape  int
+	bounds rect
+	cells  []rect
+}
+
+// Make a footprint of a shape within bounds; if the bounds are too small for
+// the shape, it's a plain rect
+func newFootprint(shape int, r rect) footprint {
+	mask := footprintMasks[shape]
+	rows, cols := len(mask), len(mask[0])
+	if r.w < cols*footprintMinCell || r.h < rows*footprintMinCell {
+		return footprint{FootprintRect, r, []rect{r}}
+	}
+	xs := footprintSplits(r.x, r.w, cols)
+	ys := footprintSplits(r.y, r.h, rows)
+	fp := footprint{shape: shape, bounds: r}
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			if mask[row][col] == 'X' {
+				fp.cells = append(fp.cells,
+					rect{xs[col], ys[row], xs[col+1] - xs[col], ys[row+1] - ys[row]})
+			}
+		}
+	}
+	return fp
+}
+
+// Random footprint shape that fits within the bounds, out of a choice of
+// shapes
+func randomFootprint(rr *rand.Rand, r rect, shapes ...int) footprint {
+	var fits []int
+	for _, shape := range shapes {
+		if newFootprint(shape, r).shape == shape {
+			fits = append(fits, shape)
+		}
+	}
+	if len(fits) == 0 {
+		return newFootprint(FootprintRect, r)
+	} else if len(fits) == 1 {
+		return newFootprint(fits[0], r)
+	}
+	return newFootprint(fits[rr.Intn(len(fits))], r)
+}
+
+// Split a length into n parts; the middle part takes the remainder so that it
+// straddles the centre
+func footprintSplits(start, length, n int) []int {
+	splits := []int{start}
+	if n == 2 {
+		return append(splits, start+length-length/2, start+length)
+	}
+	for i := 1; i < n; i++ {
+		splits = append(splits, start+length*i/n)
+	}
+	if n == 3 {
+		splits[2] = start + length - length/3
+	}
+	return append(splits, start+length)
+}
+
+func (fp footprint) isIn(x, y int) bool {
+	for _, c := range fp.cells {
+		if c.isIn(x, y) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a tile is on the outline: inside, next to a tile outside,
+// including diagonally so that walls around concave corners connect
+func (fp footprint) isOutline(x, y int) bool {
+	if !fp.isIn(x, y) {
+		return false
+	}
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if !fp.isIn(x+dx, y+dy) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether any of the walls of a room are on the outline
+func (fp footprint) touchesOutline(r rect) bool {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if (x == r.x || y == r.y || x == r.x+r.w-1 || y == r.y+r.h-1) &&
+				fp.isOutline(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Trace walls along the outline and fill the floor
+func (fp footprint) draw(g, s *Layer, tileRoom, tileWall rune) {
+	r := fp.bounds
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if fp.isOutline(x, y) {
+				s.setTile(x, y, tileWall)
+			} else if fp.isIn(x, y) {
+				g.setTile(x, y, tileRoom)
+			}
+		}
+	}
+}
+
+// Form the walls of rooms within the footprint and fill their floors, then
+// trace the outline; rooms sharing walls across a concave corner leave a gap
+// that the outline closes
+func (fp footprint) drawRooms(g, s *Layer, rooms []bspRoom, tileRoom, tileWall rune) {
+	for _, room := range rooms {
+		r := room.r
+		for y := r.y; y < r.y+r.h; y++ {
+			for x := r.x; x < r.x+r.w; x++ {
+				if !fp.isIn(x, y) {
+					continue
+				}
+				if x == r.x || y == r.y || x == r.x+r.w-1 || y == r.y+r.h-1 {
+					s.setTile(x, y, tileWall)
+				} else {
+					g.setTile(x, y, tileRoom)
+				}
+			}
+		}
+	}
+	r := fp.bounds
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if fp.isOutline(x, y) {
+				s.setTile(x, y, tileWall)
+			}
+		}
+	}
+}
+
+// Randomly partition each cell of the footprint into rooms using bsp, with
+// rooms extended up and left to share walls with neighbours in the footprint
+func (fp footprint) splitRooms(rr *rand.Rand, minRoomSize, maxRoomSize int) []bspRoom {
+	var rooms []bspRoom
+	for _, c := range fp.cells {
+		root := bspRoomRoot(c.w, c.h)
+		root.r.x, root.r.y = c.x, c.y
+		rooms = append(rooms, splitInteriorRooms(rr, root, minRoomSize, maxRoomSize)...)
+	}
+	for i := range rooms {
+		r := rooms[i].r
+		if fp.isIn(r.x-1, r.y) {
+			rooms[i].r.x--
+			rooms[i].r.w++
+		}
+		if fp.isIn(r.x, r.y-1) {
+			rooms[i].r.y--
+			rooms[i].r.h++
+		}
+	}
+	return rooms
+}
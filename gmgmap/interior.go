@@ -17,54 +17,30 @@ const (
 // TODO: improve connectedness of leaf nodes, to make it less tree-like
 func NewInterior(rr *rand.Rand, width, height, minRoomSize, maxRoomSize,
 	lobbyEdge int) *Map {
+	return NewInteriorWithOptions(rr, width, height, minRoomSize, maxRoomSize, lobbyEdge, InteriorOptions{})
+}
+
+// InteriorOptions - optional features of building interiors
+type InteriorOptions struct {
+	// The building's footprint: FootprintRect, or shaped like an L, T, U,
+	// courtyard or cross, if there's enough space; rooms are partitioned
+	// within each part of the footprint
+	Shape int
+}
+
+// NewInteriorWithOptions - create a building interior like NewInterior, with
+// an optional footprint shape
+func NewInteriorWithOptions(rr *rand.Rand, width, height, minRoomSize, maxRoomSize,
+	lobbyEdge int, opts InteriorOptions) *Map {
 	m := NewMap(width, height)
 
 	// We'll place the "road" tiles later
 	g := m.Layer("Ground")
 	s := m.Layer("Structures")
 
-	// Randomly partition the space using bsp
-	// Keep splitting as long as we can
-	var rooms []bspRoom
-	rooms = append(rooms, bspRoomRoot(width, height))
-	for i := 0; i < len(rooms); i++ {
-		if r1, r2, err := rooms[i].Split(rr, i, minRoomSize, maxRoomSize); err == nil {
-			rooms[i].child1 = len(rooms)
-			rooms = append(rooms, r1)
-			rooms[i].child2 = len(rooms)
-			rooms = append(rooms, r2)
-		}
-	}
-	// Discard non-leaf rooms
-	for i := 0; i < len(rooms); i++ {
-		if !rooms[i].IsLeaf() {
-			rooms[i] = rooms[len(rooms)-1]
-			rooms = rooms[0 : len(rooms)-1]
-			i--
-		}
-	}
-	// Adjust the rooms;
-	// BSP algo produces rooms with non-overlapping walls
-	for i := 0; i < len(rooms); i++ {
-		r := rooms[i].r
-		if r.x > 0 {
-			r.x--
-			r.w++
-		}
-		if r.y > 0 {
-			r.y--
-			r.h++
-		}
-		rooms[i].r = r
-	}
-
-	// Form the room walls
-	for i := 0; i < len(rooms); i++ {
-		r := rooms[i].r
-		s.rectangleUnfilled(r, wall2)
-		groundRect := rect{r.x + 1, r.y + 1, r.w - 2, r.h - 2}
-		g.rectangleFilled(groundRect, room)
-	}
+	fp := newFootprint(opts.Shape, rect{0, 0, width, height})
+	rooms := fp.splitRooms(rr, minRoomSize, maxRoomSize)
+	fp.drawRooms(g, s, rooms, room, wall2)
 
 	// Choose one of the rooms to be the lobby
 	var lobby bspRoom
@@ -74,13 +50,11 @@ func NewInterior(rr *rand.Rand, width, height, minRoomSize, maxRoomSize,
 		// Check if the lobby placement is ok;
 		// If it's on the edge or in the interior
 		if lobbyEdge == LobbyEdge {
-			if lobby.r.x == 0 || lobby.r.y == 0 ||
-				lobby.r.x+lobby.r.w == width || lobby.r.y+lobby.r.h == height {
+			if fp.touchesOutline(lobby.r) {
 				break
 			}
 		} else if lobbyEdge == LobbyInterior {
-			if lobby.r.x > 0 && lobby.r.y > 0 &&
-				lobby.r.x+lobby.r.w < width && lobby.r.y+lobby.r.h < height {
+			if !fp.touchesOutline(lobby.r) {
 				break
 			}
 		} else {
@@ -95,6 +69,52 @@ func NewInterior(rr *rand.Rand, width, height, minRoomSize, maxRoomSize,
 	lobbyRect.h -= 2
 	g.rectangleFilled(lobbyRect, room2)
 
+	connectInteriorRooms(g, s, rooms, lobby, room2)
+
+	return m
+}
+
+// Randomly partition the space using bsp
+// Keep splitting as long as we can, and return the leaf rooms
+func splitInteriorRooms(rr *rand.Rand, root bspRoom, minRoomSize, maxRoomSize int) []bspRoom {
+	var rooms []bspRoom
+	rooms = append(rooms, root)
+	for i := 0; i < len(rooms); i++ {
+		if r1, r2, err := rooms[i].Split(rr, i, minRoomSize, maxRoomSize); err == nil {
+			rooms[i].child1 = len(rooms)
+			rooms = append(rooms, r1)
+			rooms[i].child2 = len(rooms)
+			rooms = append(rooms, r2)
+		}
+	}
+	// Discard non-leaf rooms
+	for i := 0; i < len(rooms); i++ {
+		if !rooms[i].IsLeaf() {
+			rooms[i] = rooms[len(rooms)-1]
+			rooms = rooms[0 : len(rooms)-1]
+			i--
+		}
+	}
+	return rooms
+}
+
+// Adjust BSP rooms so that neighbours share walls, then form the room walls
+// and fill the floors
+func addInteriorRooms(g, s *Layer, rooms []bspRoom, tile rune) {
+	for i := 0; i < len(rooms); i++ {
+		rooms[i].r = sharedWalls(rooms[i].r)
+	}
+
+	for i := 0; i < len(rooms); i++ {
+		r := rooms[i].r
+		s.rectangleUnfilled(r, wall2)
+		groundRect := rect{r.x + 1, r.y + 1, r.w - 2, r.h - 2}
+		g.rectangleFilled(groundRect, tile)
+	}
+}
+
+// Connect every room to the lobby with doors, via the adjacent rooms
+func connectInteriorRooms(g, s *Layer, rooms []bspRoom, lobby bspRoom, doorTile rune) {
 	// Mark all the rooms according to their distance from the lobby (depth)
 	// Re-use the level parameter
 	overlapSize := 1
@@ -150,11 +170,23 @@ func NewInterior(rr *rand.Rand, width, height, minRoomSize, maxRoomSize,
 			maxOverlapY := imax(room.r.y, roomOther.r.y)
 			overlapX := (minOverlapX + maxOverlapX) / 2
 			overlapY := (minOverlapY + maxOverlapY) / 2
-			g.setTile(overlapX, overlapY, room2)
+			g.setTile(overlapX, overlapY, doorTile)
 			s.setTile(overlapX, overlapY, door)
 			break
 		}
 	}
+}
 
-	return m
+// BSP algo produces rooms with non-overlapping walls; extend them up and left
+// to share walls with their neighbours
+func sharedWalls(r rect) rect {
+	if r.x > 0 {
+		r.x--
+		r.w++
+	}
+	if r.y > 0 {
+		r.y--
+		r.h++
+	}
+	return r
 }
@@ -17,9 +17,21 @@ type Layer struct {
 
 // Map - a rectangular tile map
 type Map struct {
-	Layers []*Layer
-	Width  int
-	Height int
+	Layers  []*Layer
+	Objects []*Object
+	Width   int
+	Height  int
+}
+
+// Object - metadata for an area of the map, such as a region or building
+type Object struct {
+	Name       string
+	Type       string
+	X          int
+	Y          int
+	Width      int
+	Height     int
+	Properties map[string]string
 }
 
 // Tile types
@@ -35,10 +47,19 @@ const (
 	room2      = '#'
 	door       = '+'
 	doorLocked = 'x'
+	doorOneWay = '/'
+	doorSecret = '*' // looks like a wall
 	stairsUp   = '<'
 	stairsDown = '>'
 	tree       = 'T'
 	grass      = 'g'
+	water      = '='
+	lava       = '%'
+	chasm      = ':'
+	bridge     = 'b'
+	sand       = ','
+	hill       = 'n'
+	mountain   = 'M'
 
 	// flavour
 	sign       = 's'
@@ -56,6 +77,10 @@ const (
 	player     = '@'
 	flower     = 'v'
 	key        = '('
+	fence      = '&'
+	crop       = '"'
+	well       = 'O'
+	grave      = 'u'
 )
 
 // NewMap - create a new Map for a certain size
@@ -87,6 +112,13 @@ func (m *Map) Layer(name string) *Layer {
 	return m.Layers[len(m.Layers)-1]
 }
 
+// AddObject - add metadata for an area of the map
+func (m *Map) AddObject(name, objectType string, x, y, width, height int, properties map[string]string) *Object {
+	o := &Object{name, objectType, x, y, width, height, properties}
+	m.Objects = append(m.Objects, o)
+	return o
+}
+
 func (m *Map) removeLayer(name string) {
 	for i, l := range m.Layers {
 		if l.Name == name {
@@ -269,6 +301,18 @@ func (l Layer) isClear(roomX, roomY, roomWidth, roomHeight int) bool {
 	return true
 }
 
+// Whether a tile is anywhere within an area
+func (l Layer) hasTileIn(r rect, tile rune) bool {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			if l.getTile(x, y) == tile {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Count the number of tiles around a tile that match a certain tile
 // Boundary tiles count
 func (l Layer) countTiles(x, y, r int, tile rune) int {
@@ -292,7 +336,46 @@ func IsWall(tile rune) bool {
 
 // IsDoor - whether a tile is a door type
 func IsDoor(tile rune) bool {
-	return tile == door || tile == doorLocked
+	return tile == door || tile == doorLocked || tile == doorOneWay
+}
+
+// Find door tiles: those with 2 neighbour walls and 1 each of corridor/room
+func addDoors(g, s *Layer, roomTile, corridorTile rune) {
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			if IsWall(s.getTile(x, y)) {
+				continue
+			}
+			walls, corridors, rooms := 0, 0, 0
+			var countTile = func(x, y int) {
+				if IsWall(s.getTile(x, y)) {
+					walls++
+				} else {
+					switch g.getTile(x, y) {
+					case roomTile:
+						rooms++
+					case corridorTile:
+						corridors++
+					}
+				}
+			}
+			if y > 0 {
+				countTile(x, y-1)
+			}
+			if x < g.Width-1 {
+				countTile(x+1, y)
+			}
+			if y < g.Height-1 {
+				countTile(x, y+1)
+			}
+			if x > 0 {
+				countTile(x-1, y)
+			}
+			if walls == 2 && corridors == 1 && rooms == 1 {
+				s.setTile(x, y, door)
+			}
+		}
+	}
 }
 
 // Add a corridor with two turns
@@ -0,0 +1,216 @@
+package gmgmap
+
+import "math/rand"
+
+// AddCaveMaterials - add lakes, lava pools and chasms to a cave map's floor.
+// Each material is grown as blobs using a secondary cellular automata, until
+// it covers roughly the given percentage of the floor.
+// Then bridges are placed across the materials, so that the walkable floor
+// stays connected.
+func AddCaveMaterials(rr *rand.Rand, m *Map, waterPct, lavaPct, chasmPct int) {
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	materials := []struct {
+		tile rune
+		pct  int
+	}{{water, waterPct}, {lava, lavaPct}, {chasm, chasmPct}}
+	placed := false
+	for _, material := range materials {
+		if material.pct > 0 {
+			addMaterial(rr, g, s, material.tile, material.pct)
+			placed = true
+		}
+	}
+	if placed {
+		addBridges(g, s)
+	}
+}
+
+func isCaveFloor(g, s *Layer, i int) bool {
+	return g.Tiles[i] == floorTile && s.Tiles[i] != roadTile
+}
+
+func isCaveWalkable(g, s *Layer, i int) bool {
+	return (g.Tiles[i] == floorTile || g.Tiles[i] == bridge) &&
+		s.Tiles[i] != roadTile
+}
+
+func isCaveMaterial(g, s *Layer, i int) bool {
+	t := g.Tiles[i]
+	return (t == water || t == lava || t == chasm) && s.Tiles[i] != roadTile
+}
+
+func addMaterial(rr *rand.Rand, g, s *Layer, tile rune, pct int) {
+	numFloor := 0
+	for i := range g.Tiles {
+		if isCaveFloor(g, s, i) {
+			numFloor++
+		}
+	}
+	target := pct * numFloor / 100
+	if target == 0 {
+		return
+	}
+
+	// Grow blobs using the 4-5 rule, masked to the floor
+	blobs := newLayer("Blobs", g.Width, g.Height)
+	keepInFloor := func() {
+		for i := range blobs.Tiles {
+			if !isCaveFloor(g, s, i) {
+				blobs.Tiles[i] = floorTile
+			}
+		}
+	}
+	blobs.fill(floorTile)
+	for i := range blobs.Tiles {
+		if rr.Intn(100) < 50 {
+			blobs.Tiles[i] = roadTile
+		}
+	}
+	keepInFloor()
+	rule := CARule{caCounts(8, 5, 6, 7, 8), caCounts(8, 4, 5, 6, 7, 8),
+		NeighbourhoodMoore, 1, 4}
+	w := newCAWorkspace(blobs, rule.Radius)
+	for i := 0; i < rule.Repeat; i++ {
+		rule.apply(blobs, w)
+		keepInFloor()
+	}
+
+	// Label the blobs, then place them in random order until we reach the
+	// target, skipping blobs that would overshoot by too much
+	index := rune(-1)
+	for i := range blobs.Tiles {
+		if blobs.Tiles[i] == roadTile {
+			blobs.floodFill(i%blobs.Width, i/blobs.Width, index)
+			index--
+		}
+	}
+	blobTiles := make([][]int, -index-1)
+	for i, t := range blobs.Tiles {
+		if t < 0 {
+			blobTiles[-t-1] = append(blobTiles[-t-1], i)
+		}
+	}
+	placed := 0
+	for _, b := range rr.Perm(len(blobTiles)) {
+		if placed >= target {
+			break
+		}
+		if placed > 0 && placed+len(blobTiles[b]) > target*3/2 {
+			continue
+		}
+		for _, i := range blobTiles[b] {
+			g.Tiles[i] = tile
+			// Clear the cellular automata floor from the structure layer so
+			// the material shows
+			s.Tiles[i] = nothing
+		}
+		placed += len(blobTiles[b])
+	}
+}
+
+// Place bridges over materials until all walkable tiles are connected.
+// Starting from one area, repeatedly find the unconnected walkable tile that
+// needs the fewest bridge tiles to reach, then bridge it.
+func addBridges(g, s *Layer) {
+	connected := make([]bool, len(g.Tiles))
+	floodConnected := func(start int) {
+		connected[start] = true
+		frontier := []int{start}
+		for len(frontier) > 0 {
+			i := frontier[len(frontier)-1]
+			frontier = frontier[:len(frontier)-1]
+			for _, j := range g.neighbourIndices(i) {
+				if !connected[j] && isCaveWalkable(g, s, j) {
+					connected[j] = true
+					frontier = append(frontier, j)
+				}
+			}
+		}
+	}
+	start := -1
+	for i := range g.Tiles {
+		if isCaveWalkable(g, s, i) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return
+	}
+	floodConnected(start)
+
+	for {
+		// 0-1 breadth first search; crossing materials costs 1
+		visited := make([]bool, len(g.Tiles))
+		prev := make([]int, len(g.Tiles))
+		var level []int
+		for i := range connected {
+			if connected[i] {
+				visited[i] = true
+				level = append(level, i)
+			}
+		}
+		found := -1
+		for len(level) > 0 && found < 0 {
+			var next []int
+			for k := 0; k < len(level) && found < 0; k++ {
+				i := level[k]
+				for _, j := range g.neighbourIndices(i) {
+					if visited[j] {
+						continue
+					}
+					if isCaveWalkable(g, s, j) {
+						visited[j] = true
+						prev[j] = i
+						if !connected[j] {
+							found = j
+							break
+						}
+						level = append(level, j)
+					} else if isCaveMaterial(g, s, j) {
+						visited[j] = true
+						prev[j] = i
+						next = append(next, j)
+					}
+				}
+			}
+			level = next
+		}
+		if found < 0 {
+			break
+		}
+		for i := prev[found]; !connected[i]; i = prev[i] {
+			g.Tiles[i] = bridge
+		}
+		floodConnected(found)
+	}
+}
+
+// Indices of the up/right/down/left neighbours of a tile
+func (l Layer) neighbourIndices(i int) []int {
+	x, y := i%l.Width, i/l.Width
+	var indices []int
+	if y > 0 {
+		indices = append(indices, i-l.Width)
+	}
+	if x < l.Width-1 {
+		indices = append(indices, i+1)
+	}
+	if y < l.Height-1 {
+		indices = append(indices, i+l.Width)
+	}
+	if x > 0 {
+		indices = append(indices, i-1)
+	}
+	return indices
+}
+
+// Make birth/survival counts for a cellular automata rule
+func caCounts(maxCount int, counts ...int) []bool {
+	c := make([]bool, maxCount+1)
+	for _, n := range counts {
+		c[n] = true
+	}
+	return c
+}
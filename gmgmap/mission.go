@@ -0,0 +1,328 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Key colours, in order of use
+var keyColours = []string{"red", "blue", "green", "yellow", "purple", "orange", "cyan", "white"}
+
+func keyColour(i int) string {
+	if i < len(keyColours) {
+		return keyColours[i]
+	}
+	return "colour" + strconv.Itoa(i)
+}
+
+// A map divided into areas of walkable tiles, connected by doorways.
+// This is the room graph of any map, regardless of which generator made it.
+type areaGraph struct {
+	width    int
+	areas    []int // area of each tile, or -1
+	numAreas int
+	doorways []doorway
+}
+
+// A group of adjacent door tiles, and the areas either side.
+// One-way doors can only be entered from one area, or from any area if
+// their direction isn't known.
+type doorway struct {
+	tiles []int
+	areas []int
+	entry int
+}
+
+// Names of the directions one-way doors can be passed through, recorded in
+// the "direction" property of their map objects
+var doorDirections = []string{"up", "right", "down", "left"}
+
+// Whether a tile can be walked on, not counting doors
+func isMissionWalkable(g, s *Layer, i int) bool {
+	switch g.Tiles[i] {
+	case nothing, water, lava, chasm:
+		return false
+	}
+	switch s.Tiles[i] {
+	case nothing, floorTile, stairsUp, stairsDown:
+		return true
+	}
+	return false
+}
+
+func newAreaGraph(m *Map) areaGraph {
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	ag := areaGraph{m.Width, make([]int, len(g.Tiles)), 0, nil}
+	for i := range ag.areas {
+		ag.areas[i] = -1
+	}
+	// Flood fill areas and doorways
+	doorwayOf := make([]int, len(g.Tiles))
+	for i := range doorwayOf {
+		doorwayOf[i] = -1
+	}
+	fill := func(start int, isIn func(int) bool, set func(int)) {
+		set(start)
+		frontier := []int{start}
+		for len(frontier) > 0 {
+			i := frontier[len(frontier)-1]
+			frontier = frontier[:len(frontier)-1]
+			for _, j := range g.neighbourIndices(i) {
+				if isIn(j) {
+					set(j)
+					frontier = append(frontier, j)
+				}
+			}
+		}
+	}
+	for i := range g.Tiles {
+		if ag.areas[i] < 0 && isMissionWalkable(g, s, i) {
+			area := ag.numAreas
+			ag.numAreas++
+			fill(i, func(j int) bool {
+				return ag.areas[j] < 0 && isMissionWalkable(g, s, j)
+			}, func(j int) {
+				ag.areas[j] = area
+			})
+		}
+	}
+	// Secret doors can be walked through once they're found
+	isDoorway := func(i int) bool {
+		return IsDoor(s.Tiles[i]) || s.Tiles[i] == doorSecret
+	}
+	for i := range g.Tiles {
+		if doorwayOf[i] < 0 && isDoorway(i) {
+			d := len(ag.doorways)
+			ag.doorways = append(ag.doorways, doorway{entry: -1})
+			fill(i, func(j int) bool {
+				return doorwayOf[j] < 0 && isDoorway(j)
+			}, func(j int) {
+				doorwayOf[j] = d
+				ag.doorways[d].tiles = append(ag.doorways[d].tiles, j)
+			})
+		}
+	}
+	for d := range ag.doorways {
+		seen := map[int]bool{}
+		for _, i := range ag.doorways[d].tiles {
+			for _, j := range g.neighbourIndices(i) {
+				if area := ag.areas[j]; area >= 0 && !seen[area] {
+					seen[area] = true
+					ag.doorways[d].areas = append(ag.doorways[d].areas, area)
+				}
+			}
+			if s.Tiles[i] == doorOneWay {
+				ag.doorways[d].entry = oneWayEntry(m, ag.areas, i)
+			}
+		}
+	}
+	return ag
+}
+
+// The area a one-way door is entered from, behind it in the direction
+// recorded in its map object, or -1 if there's no direction
+func oneWayEntry(m *Map, areas []int, i int) int {
+	x, y := i%m.Width, i/m.Width
+	for _, o := range m.Objects {
+		if o.X != x || o.Y != y {
+			continue
+		}
+		for dir, name := range doorDirections {
+			if o.Properties["direction"] == name {
+				bx, by := x-walkOffsets[dir].x, y-walkOffsets[dir].y
+				if m.Layer("Ground").isIn(bx, by) {
+					return areas[bx+by*m.Width]
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// Find the area containing a tile on any layer
+func (ag areaGraph) findArea(m *Map, tile rune) int {
+	for _, l := range m.Layers {
+		for i, t := range l.Tiles {
+			if t == tile && ag.areas[i] >= 0 {
+				return ag.areas[i]
+			}
+		}
+	}
+	return -1
+}
+
+// Breadth first search over areas from a start area, through doorways that
+// are open, and only through one-way doors from their entry side. Returns the distance to each area, or -1 if unreachable, and the
+// doorway used to reach each area.
+func (ag areaGraph) search(start int, isOpen func(d int) bool) ([]int, []int) {
+	distance := make([]int, ag.numAreas)
+	via := make([]int, ag.numAreas)
+	for i := range distance {
+		distance[i] = -1
+		via[i] = -1
+	}
+	distance[start] = 0
+	frontier := []int{start}
+	for len(frontier) > 0 {
+		area := frontier[0]
+		frontier = frontier[1:]
+		for d, dw := range ag.doorways {
+			if !isOpen(d) || !dw.connects(area) || (dw.entry >= 0 && dw.entry != area) {
+				continue
+			}
+			for _, next := range dw.areas {
+				if distance[next] < 0 {
+					distance[next] = distance[area] + 1
+					via[next] = d
+					frontier = append(frontier, next)
+				}
+			}
+		}
+	}
+	return distance, via
+}
+
+func (dw doorway) connects(area int) bool {
+	for _, a := range dw.areas {
+		if a == area {
+			return true
+		}
+	}
+	return false
+}
+
+// AddLocksAndKeys - lock doors on the way from the stairs up (or player) to
+// the stairs down, and place a matching coloured key for each lock.
+// This works on any map with doors, by dividing it into areas between doors.
+// Only doors that can't be bypassed are locked, i.e. those that every way to
+// the stairs down goes through, and only ordinary doors: locked, one-way and
+// secret doors are left as they are.
+// Keys are placed so that the map is solvable: the first key can be reached
+// without opening any new locks, the second key can be reached once the first
+// lock is open, and so on. Keys are placed in the furthest areas available,
+// to encourage exploration.
+// Locks and keys are recorded as map objects, with their colours.
+// Returns the number of locks placed.
+func AddLocksAndKeys(rr *rand.Rand, m *Map, numLocks int) int {
+	ag := newAreaGraph(m)
+	start := ag.findArea(m, stairsUp)
+	if start < 0 {
+		start = ag.findArea(m, player)
+	}
+	goal := ag.findArea(m, stairsDown)
+	if start < 0 || goal < 0 || start == goal {
+		return 0
+	}
+
+	// Pick doorways along the critical path to lock, in order from the start,
+	// where there's no other way to the goal
+	s := m.Layer("Structures")
+	all := func(int) bool { return true }
+	distance, via := ag.search(start, all)
+	if distance[goal] < 0 {
+		return 0
+	}
+	var path []int
+	for area := goal; area != start; {
+		d := via[area]
+		without, _ := ag.search(start, func(o int) bool { return o != d })
+		if without[goal] < 0 && ag.doorways[d].isOrdinary(s) {
+			path = append([]int{d}, path...)
+		}
+		for _, a := range ag.doorways[d].areas {
+			if distance[a] == distance[area]-1 {
+				area = a
+				break
+			}
+		}
+	}
+	numLocks = imin(numLocks, len(path))
+	if numLocks == 0 {
+		return 0
+	}
+	locks := rr.Perm(len(path))[:numLocks]
+	sort.Ints(locks)
+	for i := range locks {
+		locks[i] = path[locks[i]]
+	}
+	isLocked := make([]bool, len(ag.doorways))
+	for _, d := range locks {
+		isLocked[d] = true
+	}
+
+	g := m.Layer("Ground")
+	c := m.Layer("Characters")
+	var prevReachable []int
+	placed := 0
+	for k, d := range locks {
+		// Areas reachable with this and later locks closed
+		reachable, _ := ag.search(start, func(d int) bool { return !isLocked[d] })
+		// Prefer the furthest newly reachable area
+		best := -1
+		for area, distance := range reachable {
+			if distance < 0 || !ag.hasKeySpace(g, s, c, area) {
+				continue
+			}
+			isNew := prevReachable == nil || prevReachable[area] < 0
+			bestIsNew := best >= 0 && (prevReachable == nil || prevReachable[best] < 0)
+			if best < 0 || (isNew && !bestIsNew) ||
+				(isNew == bestIsNew && distance > reachable[best]) {
+				best = area
+			}
+		}
+		if best < 0 {
+			// Nowhere to put the key; leave this and later doors unlocked
+			break
+		}
+		colour := keyColour(k)
+		kx, ky := ag.placeKey(rr, g, s, c, best)
+		m.AddObject(fmt.Sprintf("Key %d", k), "key", kx, ky, 1, 1,
+			map[string]string{"colour": colour})
+		tiles := ag.doorways[d].tiles
+		for _, i := range tiles {
+			s.Tiles[i] = doorLocked
+		}
+		m.AddObject(fmt.Sprintf("Lock %d", k), "lock",
+			tiles[0]%m.Width, tiles[0]/m.Width, 1, 1,
+			map[string]string{"colour": colour, "key": fmt.Sprintf("Key %d", k)})
+		isLocked[d] = false
+		prevReachable = reachable
+		placed++
+	}
+	return placed
+}
+
+func (dw doorway) isOrdinary(s *Layer) bool {
+	for _, i := range dw.tiles {
+		if s.Tiles[i] != door {
+			return false
+		}
+	}
+	return true
+}
+
+func (ag areaGraph) hasKeySpace(g, s, c *Layer, area int) bool {
+	for i, a := range ag.areas {
+		if a == area && s.Tiles[i] != stairsUp && s.Tiles[i] != stairsDown &&
+			c.Tiles[i] == nothing {
+			return true
+		}
+	}
+	return false
+}
+
+func (ag areaGraph) placeKey(rr *rand.Rand, g, s, c *Layer, area int) (int, int) {
+	var tiles []int
+	for i, a := range ag.areas {
+		if a == area && s.Tiles[i] != stairsUp && s.Tiles[i] != stairsDown &&
+			c.Tiles[i] == nothing {
+			tiles = append(tiles, i)
+		}
+	}
+	i := tiles[rr.Intn(len(tiles))]
+	c.Tiles[i] = key
+	return i % ag.width, i / ag.width
+}
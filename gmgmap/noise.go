@@ -0,0 +1,106 @@
+package gmgmap
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Gradient noise (Perlin noise), seeded from a random source
+type noise struct {
+	perm [512]int
+}
+
+func newNoise(rr *rand.Rand) *noise {
+	n := new(noise)
+	p := rr.Perm(256)
+	for i := range n.perm {
+		n.perm[i] = p[i%256]
+	}
+	return n
+}
+
+// Get the noise value at a point, roughly in the range [-1, 1]
+func (n *noise) at(x, y float64) float64 {
+	xf, yf := math.Floor(x), math.Floor(y)
+	xi, yi := int(xf)&255, int(yf)&255
+	x, y = x-xf, y-yf
+	u, v := fade(x), fade(y)
+	aa := n.perm[n.perm[xi]+yi]
+	ab := n.perm[n.perm[xi]+yi+1]
+	ba := n.perm[n.perm[xi+1]+yi]
+	bb := n.perm[n.perm[xi+1]+yi+1]
+	return lerp(
+		lerp(grad(aa, x, y), grad(ba, x-1, y), u),
+		lerp(grad(ab, x, y-1), grad(bb, x-1, y-1), u),
+		v)
+}
+
+// Fractal noise - sum octaves of noise, each with double the frequency and
+// half the amplitude of the last
+func (n *noise) fractal(x, y float64, octaves int) float64 {
+	sum, amplitude, frequency, total := 0.0, 1.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amplitude * n.at(x*frequency, y*frequency)
+		total += amplitude
+		amplitude /= 2
+		frequency *= 2
+	}
+	return sum / total
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(a, b, t float64) float64 {
+	return a + t*(b-a)
+}
+
+// Dot product of one of 8 gradient directions with the offset
+func grad(hash int, x, y float64) float64 {
+	switch hash & 7 {
+	case 0:
+		return x + y
+	case 1:
+		return -x + y
+	case 2:
+		return x - y
+	case 3:
+		return -x - y
+	case 4:
+		return x
+	case 5:
+		return -x
+	case 6:
+		return y
+	default:
+		return -y
+	}
+}
+
+// Generate a field of fractal noise values for every tile, normalised to
+// [0, 1]; featureSize is roughly the size of features in tiles
+func noiseField(rr *rand.Rand, width, height int, featureSize float64, octaves int) []float64 {
+	n := newNoise(rr)
+	// Offset randomly as noise is always 0 at integer points
+	offsetX, offsetY := rr.Float64()*256, rr.Float64()*256
+	field := make([]float64, width*height)
+	minV, maxV := math.Inf(1), math.Inf(-1)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := n.fractal(
+				float64(x)/featureSize+offsetX, float64(y)/featureSize+offsetY, octaves)
+			field[x+y*width] = v
+			minV = math.Min(minV, v)
+			maxV = math.Max(maxV, v)
+		}
+	}
+	for i := range field {
+		if maxV > minV {
+			field[i] = (field[i] - minV) / (maxV - minV)
+		} else {
+			field[i] = 0
+		}
+	}
+	return field
+}
@@ -0,0 +1,74 @@
+package gmgmap
+
+import "math/rand"
+
+// NewOverworld - create a world map, using noise fields for elevation and
+// moisture, classified into biomes:
+// - water, then sand (beaches) at the lowest elevations
+// - mountains, then hills at the highest elevations
+// - forest or grass in between, depending on moisture
+// featureSize is roughly the size of continents/biomes, in tiles, and at
+// least 1.
+func NewOverworld(rr *rand.Rand, exportFunc func(*Map), width, height, featureSize int) *Map {
+	return NewOverworldWithOptions(rr, exportFunc, width, height, featureSize, OverworldOptions{})
+}
+
+// OverworldOptions - optional features of world maps
+type OverworldOptions struct {
+	// Rivers flow downhill over the same elevation field as the biomes
+	NumRivers int
+}
+
+// NewOverworldWithOptions - create a world map like NewOverworld, with
+// optional rivers
+func NewOverworldWithOptions(rr *rand.Rand, exportFunc func(*Map), width, height, featureSize int, opts OverworldOptions) *Map {
+	m := NewMap(width, height)
+	elevation := addBiomes(rr, m, exportFunc, featureSize)
+	addRivers(rr, m, opts.NumRivers, elevation, featureSize)
+	return m
+}
+
+// Classify terrain into biomes; returns the elevation field
+func addBiomes(rr *rand.Rand, m *Map, exportFunc func(*Map), featureSize int) []float64 {
+	width, height := m.Width, m.Height
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	featureSize = imax(featureSize, 1)
+
+	elevation := noiseField(rr, width, height, float64(featureSize), 4)
+	moisture := noiseField(rr, width, height, float64(featureSize), 3)
+
+	// Ground - water, sand and grass
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			e := elevation[x+y*width]
+			switch {
+			case e < 0.35:
+				g.setTile(x, y, water)
+			case e < 0.4:
+				g.setTile(x, y, sand)
+			default:
+				g.setTile(x, y, grass)
+			}
+		}
+	}
+	exportFunc(m)
+
+	// Structures - forests, hills and mountains
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			e := elevation[x+y*width]
+			switch {
+			case e < 0.4:
+			case e > 0.8:
+				s.setTile(x, y, mountain)
+			case e > 0.68:
+				s.setTile(x, y, hill)
+			case moisture[x+y*width] > 0.55:
+				s.setTile(x, y, tree)
+			}
+		}
+	}
+	exportFunc(m)
+	return elevation
+}
@@ -0,0 +1,375 @@
+package gmgmap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+)
+
+// Prefab-only tile types
+const (
+	prefabEntrance = 'E' // connected to the map with a door, or walled up
+	prefabOptional = '?' // randomly wall or floor
+)
+
+// DefaultPrefabs - some set pieces to stamp into dungeons
+const DefaultPrefabs = `; vault
+WWWWWWW
+W)).))W
+W).).)W
+W)).))W
+WWW+WWW
+  WEW
+
+; shrine
+ WWWWW
+WW...WW
+W..v..W
+E.v{v.E
+W..v..W
+WW...WW
+ WWWWW
+
+; arena
+WWWWWEWWWWW
+W.........W
+W.?.....?.W
+W....A....W
+W.?.....?.W
+W.........W
+WWWWWEWWWWW
+
+; stairwell
+WWWWW
+W?.?W
+E.>.E
+W?.?W
+WWWWW`
+
+// Prefab - a hand-authored set piece, made of the same tiles as Map.Print,
+// plus entrances (E) and optional cells (?). Spaces are left untouched.
+type Prefab struct {
+	Name   string
+	Width  int
+	Height int
+	Cells  []rune
+}
+
+// ParsePrefabs - parse prefabs from ASCII, separated by blank lines.
+// Lines starting with ; name the prefab that follows.
+func ParsePrefabs(s string) ([]Prefab, error) {
+	var prefabs []Prefab
+	var name string
+	var lines []string
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		p, err := parsePrefab(name, lines)
+		if err != nil {
+			return err
+		}
+		prefabs = append(prefabs, p)
+		name, lines = "", nil
+		return nil
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		switch {
+		case strings.TrimSpace(line) == "":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, ";"):
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			name = strings.TrimSpace(line[1:])
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return prefabs, nil
+}
+
+// LoadPrefabs - load prefabs from an ASCII file
+func LoadPrefabs(path string) ([]Prefab, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrefabs(string(b))
+}
+
+func parsePrefab(name string, lines []string) (Prefab, error) {
+	p := Prefab{name, 0, len(lines), nil}
+	for _, line := range lines {
+		p.Width = imax(p.Width, len([]rune(line)))
+	}
+	p.Cells = make([]rune, p.Width*p.Height)
+	for i := range p.Cells {
+		p.Cells[i] = nothing
+	}
+	for y, line := range lines {
+		for x, c := range []rune(line) {
+			if c != nothing && c != prefabEntrance && c != prefabOptional &&
+				prefabLayer(c) == "" {
+				return p, fmt.Errorf("prefab %q: unknown tile %q at %d,%d", name, c, x, y)
+			}
+			p.Cells[x+y*p.Width] = c
+		}
+	}
+	return p, nil
+}
+
+// Rotate 90 degrees clockwise
+func (p Prefab) rotate() Prefab {
+	r := Prefab{p.Name, p.Height, p.Width, make([]rune, len(p.Cells))}
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			r.Cells[(p.Height-1-y)+x*r.Width] = p.Cells[x+y*p.Width]
+		}
+	}
+	return r
+}
+
+// Mirror horizontally
+func (p Prefab) mirror() Prefab {
+	r := Prefab{p.Name, p.Width, p.Height, make([]rune, len(p.Cells))}
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			r.Cells[(p.Width-1-x)+y*p.Width] = p.Cells[x+y*p.Width]
+		}
+	}
+	return r
+}
+
+func (p Prefab) cell(x, y int) rune {
+	if x < 0 || y < 0 || x >= p.Width || y >= p.Height {
+		return nothing
+	}
+	return p.Cells[x+y*p.Width]
+}
+
+func (p Prefab) hasTile(tile rune) bool {
+	for _, c := range p.Cells {
+		if c == tile {
+			return true
+		}
+	}
+	return false
+}
+
+// Which layer a tile belongs in
+func prefabLayer(tile rune) string {
+	switch tile {
+	case floor, floor2, road, road2, room, room2, grass, water, lava, chasm,
+		bridge, sand:
+		return "Ground"
+	case wall, wall2, door, doorLocked, doorOneWay, doorSecret, stairsUp,
+		stairsDown, tree, hill, mountain, fence, well:
+		return "Structures"
+	case sign, hanging, window, counter, shelf, table, chair, rug, pot, flower,
+		crop, grave:
+		return "Furniture"
+	case stock:
+		return "Inventory"
+	case shopkeeper, assistant, player, key:
+		return "Characters"
+	}
+	return ""
+}
+
+// StampPrefabs - stamp up to count randomly chosen prefabs into free space
+// in a map, with random rotation and mirroring.
+// Free space is anywhere that's empty, or solid cave rock.
+// Entrances are connected to the nearest walkable tile with a corridor and a
+// door, or walled up if they can't be; prefabs with entrances are only
+// placed if at least one entrance connects.
+// Prefabs with stairs down are skipped if the map already has stairs down, so
+// there's only ever one way down.
+// Each stamped prefab is recorded as a map object.
+// Returns the number of prefabs stamped.
+func StampPrefabs(rr *rand.Rand, m *Map, prefabs []Prefab, count int) int {
+	if len(prefabs) == 0 {
+		return 0
+	}
+	for _, name := range []string{"Ground", "Structures", "Furniture", "Inventory", "Characters"} {
+		m.Layer(name)
+	}
+	stamped := 0
+	for i := 0; i < count*100 && stamped < count; i++ {
+		p := prefabs[rr.Intn(len(prefabs))]
+		if p.hasTile(stairsDown) {
+			if x, _ := findTile(m, stairsDown); x >= 0 {
+				continue
+			}
+		}
+		for r := rr.Intn(4); r > 0; r-- {
+			p = p.rotate()
+		}
+		if rr.Intn(2) == 0 {
+			p = p.mirror()
+		}
+		if p.Width > m.Width || p.Height > m.Height {
+			continue
+		}
+		x := rr.Intn(m.Width - p.Width + 1)
+		y := rr.Intn(m.Height - p.Height + 1)
+		if stampPrefab(rr, m, p, x, y) {
+			stamped++
+		}
+	}
+	return stamped
+}
+
+// Whether a tile is free for stamping: empty, or solid cave rock
+func isPrefabFree(m *Map, x, y int) bool {
+	if m.Layer("Structures").getTile(x, y) == roadTile {
+		return true
+	}
+	for _, l := range m.Layers {
+		if l.getTile(x, y) != nothing {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a tile can be walked on, for connecting entrances
+func isPrefabWalkable(g, s *Layer, x, y int) bool {
+	switch g.getTile(x, y) {
+	case nothing, water, lava, chasm:
+		return false
+	}
+	t := s.getTile(x, y)
+	return t == nothing || t == floorTile || IsDoor(t)
+}
+
+func stampPrefab(rr *rand.Rand, m *Map, p Prefab, x, y int) bool {
+	for py := 0; py < p.Height; py++ {
+		for px := 0; px < p.Width; px++ {
+			if p.cell(px, py) != nothing && !isPrefabFree(m, x+px, y+py) {
+				return false
+			}
+		}
+	}
+	saved := make([][]rune, len(m.Layers))
+	for i, l := range m.Layers {
+		saved[i] = append([]rune{}, l.Tiles...)
+	}
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+
+	var entrances []vec2
+	for py := 0; py < p.Height; py++ {
+		for px := 0; px < p.Width; px++ {
+			c := p.cell(px, py)
+			mx, my := x+px, y+py
+			switch c {
+			case nothing:
+				continue
+			case prefabEntrance:
+				entrances = append(entrances, vec2{px, py})
+				c = wall2
+			case prefabOptional:
+				c = wall2
+				if rr.Intn(2) == 0 {
+					c = room
+				}
+			}
+			// Clear the space, then fill in the tile; floor goes under
+			// everything but walls and ground tiles
+			for _, l := range m.Layers {
+				l.setTile(mx, my, nothing)
+			}
+			layer := prefabLayer(c)
+			if !IsWall(c) && layer != "Ground" {
+				g.setTile(mx, my, room)
+			}
+			m.Layer(layer).setTile(mx, my, c)
+		}
+	}
+
+	connected := 0
+	for _, e := range entrances {
+		if connectPrefabEntrance(m, g, s, p, x, y, e) {
+			connected++
+		}
+	}
+	if len(entrances) > 0 && connected == 0 {
+		for i, l := range m.Layers {
+			copy(l.Tiles, saved[i])
+		}
+		return false
+	}
+
+	name := p.Name
+	if name == "" {
+		name = "prefab"
+	}
+	m.AddObject(name, "prefab", x, y, p.Width, p.Height, map[string]string{})
+	return true
+}
+
+// Connect a prefab entrance to the nearest walkable tile, by carving through
+// free space. The corridor copies the tiles it connects to, so it matches
+// dungeon corridors or cave floors.
+func connectPrefabEntrance(m *Map, g, s *Layer, p Prefab, x, y int, e vec2) bool {
+	// Find the way out of the prefab
+	var out vec2
+	found := false
+	for _, d := range walkOffsets {
+		if p.cell(e.x+d.x, e.y+d.y) == nothing && g.isIn(x+e.x+d.x, y+e.y+d.y) {
+			out = vec2{x + e.x + d.x, y + e.y + d.y}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	// Breadth first search through free space
+	prev := map[vec2]vec2{out: out}
+	frontier := []vec2{out}
+	end := vec2{-1, -1}
+	for len(frontier) > 0 && end.x < 0 {
+		t := frontier[0]
+		frontier = frontier[1:]
+		if isPrefabWalkable(g, s, t.x, t.y) {
+			end = t
+			break
+		}
+		if !isPrefabFree(m, t.x, t.y) {
+			continue
+		}
+		for _, d := range walkOffsets {
+			n := vec2{t.x + d.x, t.y + d.y}
+			if _, ok := prev[n]; ok || !g.isIn(n.x, n.y) {
+				continue
+			}
+			prev[n] = t
+			frontier = append(frontier, n)
+		}
+	}
+	if end.x < 0 {
+		return false
+	}
+	corridorGround, corridorStructure := g.getTile(end.x, end.y), s.getTile(end.x, end.y)
+	if IsDoor(corridorStructure) {
+		corridorStructure = nothing
+	}
+	for t := prev[end]; t != end; t = prev[t] {
+		g.setTile(t.x, t.y, corridorGround)
+		s.setTile(t.x, t.y, corridorStructure)
+		if t == out {
+			break
+		}
+	}
+	g.setTile(x+e.x, y+e.y, room)
+	s.setTile(x+e.x, y+e.y, door)
+	return true
+}
@@ -0,0 +1,44 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestParsePrefabs(t *testing.T) {
+	prefabs, err := ParsePrefabs(DefaultPrefabs)
+	if err != nil {
+		t.Fatalf("default prefabs: %v", err)
+	}
+	if len(prefabs) != 4 || prefabs[0].Name != "vault" || prefabs[3].Name != "stairwell" {
+		t.Errorf("default prefabs: got %d prefabs", len(prefabs))
+	}
+	if p := prefabs[1]; p.Width != 7 || p.Height != 7 || p.cell(0, 0) != nothing {
+		t.Errorf("shrine: %dx%d with corner %q", p.Width, p.Height, p.cell(0, 0))
+	}
+	for _, s := range []string{
+		"; bad\nWWW\nWZW\nWWW",
+		"; ok\nWWW\n\n; bad\nWQW",
+	} {
+		if _, err := ParsePrefabs(s); err == nil {
+			t.Errorf("%q: no error for unknown tile", s)
+		}
+	}
+	if prefabs, err := ParsePrefabs("\r\n; only comments\r\n\r\n"); err != nil || len(prefabs) != 0 {
+		t.Errorf("empty prefabs: got %d prefabs, error %v", len(prefabs), err)
+	}
+}
+
+func TestStampPrefabsStairs(t *testing.T) {
+	prefabs, err := ParsePrefabs("; stairwell\nWWW\nW>W\nWWW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMap(10, 10)
+	if n := StampPrefabs(rand.New(rand.NewSource(1)), m, prefabs, 3); n != 1 {
+		t.Errorf("stamped %d stairwells, want 1", n)
+	}
+	if n := len(findTiles(m, stairsDown)); n != 1 {
+		t.Errorf("%d stairs down, want 1", n)
+	}
+}
@@ -15,3 +15,96 @@ func NewRandomWalk(rr *rand.Rand, width, height, iterations int) *Map {
 	}
 	return m
 }
+
+// Directions, for biasing walkers
+const (
+	DirectionNone = iota
+	DirectionUp
+	DirectionRight
+	DirectionDown
+	DirectionLeft
+)
+
+// Drunkard walk modes
+const (
+	WalkTrees = iota
+	WalkDungeon
+)
+
+// Offsets for up/right/down/left
+var walkOffsets = []vec2{{0, -1}, {1, 0}, {0, 1}, {-1, 0}}
+
+type walker struct {
+	x, y, dir int
+}
+
+// NewDrunkardWalk - create a map using multiple random walkers.
+// Walkers start in the middle; each step they may spawn a new walker
+// (spawnPct) or die (deathPct), up to maxWalkers at a time.
+// Walkers keep going the same way with persistence (0-100), otherwise they
+// head in the bias direction with bias (0-100), or a random direction.
+// Unknown directions are treated as DirectionNone.
+// Walking continues until fillPct of the map is walked.
+// Walked tiles either have trees placed, or in dungeon mode, are carved out
+// of solid rock.
+func NewDrunkardWalk(rr *rand.Rand, exportFunc func(*Map), width, height, maxWalkers, spawnPct, deathPct, direction, bias, persistence, fillPct, mode int) *Map {
+	m := NewMap(width, height)
+	if direction < DirectionNone || direction > DirectionLeft {
+		direction = DirectionNone
+	}
+	m.Layer("Ground").fill(floor)
+	l := m.Layer("Structures")
+	r := rect{0, 0, width, height}
+	walked := tree
+	if mode == WalkDungeon {
+		// Keep a border of rock
+		l.fill(roadTile)
+		r = rect{1, 1, width - 2, height - 2}
+		walked = floorTile
+	}
+	if r.w < 1 || r.h < 1 {
+		return m
+	}
+
+	numWalked := 0
+	target := fillPct * r.w * r.h / 100
+	exportInterval := imax(target/20, 1)
+	walkers := []walker{{width / 2, height / 2, rr.Intn(4)}}
+	for i := 0; numWalked < target && i < r.w*r.h*100; i++ {
+		for j := range walkers {
+			w := &walkers[j]
+			if l.getTile(w.x, w.y) != walked {
+				l.setTile(w.x, w.y, walked)
+				numWalked++
+				if numWalked%exportInterval == 0 {
+					exportFunc(m)
+				}
+			}
+			switch {
+			case rr.Intn(100) < persistence:
+			case direction != DirectionNone && rr.Intn(100) < bias:
+				w.dir = direction - DirectionUp
+			default:
+				w.dir = rr.Intn(4)
+			}
+			// Turn around at the edges
+			d := walkOffsets[w.dir]
+			if !r.isIn(w.x+d.x, w.y+d.y) {
+				w.dir = rr.Intn(4)
+				continue
+			}
+			w.x, w.y = w.x+d.x, w.y+d.y
+		}
+		if len(walkers) < maxWalkers && rr.Intn(100) < spawnPct {
+			w := walkers[rr.Intn(len(walkers))]
+			walkers = append(walkers, walker{w.x, w.y, rr.Intn(4)})
+		}
+		// Always keep at least one walker
+		if len(walkers) > 1 && rr.Intn(100) < deathPct {
+			j := rr.Intn(len(walkers))
+			walkers = append(walkers[:j], walkers[j+1:]...)
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,21 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestNewDrunkardWalkDirections(t *testing.T) {
+	for direction := DirectionNone - 1; direction <= DirectionLeft+1; direction++ {
+		m := NewDrunkardWalk(rand.New(rand.NewSource(1)), func(*Map) {}, 20, 20, 2, 10, 5, direction, 50, 0, 30, WalkDungeon)
+		walked := 0
+		for _, t := range m.Layer("Structures").Tiles {
+			if t == floorTile {
+				walked++
+			}
+		}
+		if walked < 18*18*30/100 {
+			t.Errorf("direction %d: walked %d tiles", direction, walked)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/beefsack/go-astar"
+)
+
+// NewRegion - create a region map with several villages and landmarks on
+// overworld terrain, connected by a road network.
+// Settlements are connected by a minimum spanning tree plus a few extra
+// edges, where each road is routed with A* over the terrain: roads prefer
+// grass, avoid forests and hills, bridge over water when they have to, and
+// cannot cross mountains.
+// Like village paths, existing roads are cheaper to travel on, so routes merge
+// into main roads, which are graded by how much traffic they carry.
+func NewRegion(rr *rand.Rand, exportFunc func(*Map), width, height, numVillages, numLandmarks, buildingPadding, featureSize int) *Map {
+	return NewRegionWithOptions(rr, exportFunc, width, height, numVillages, numLandmarks, buildingPadding, featureSize, RegionOptions{})
+}
+
+// RegionOptions - optional features of regions
+type RegionOptions struct {
+	// Villages are walled, with roads connecting to each of their gates
+	Walled bool
+	// Rivers flow downhill over the terrain before anything is built, so
+	// settlements are placed away from them, and roads bridge them
+	NumRivers int
+}
+
+// NewRegionWithOptions - create a region like NewRegion, with optional
+// walled villages and rivers
+func NewRegionWithOptions(rr *rand.Rand, exportFunc func(*Map), width, height, numVillages, numLandmarks, buildingPadding, featureSize int, opts RegionOptions) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	f := m.Layer("Furniture")
+
+	elevation := addBiomes(rr, m, exportFunc, featureSize)
+	addRivers(rr, m, opts.NumRivers, elevation, featureSize)
+	exportFunc(m)
+
+	// Villages
+	var settlements []rect
+	var nodes []vec2
+	var groups []int
+	for i := 0; i < numVillages; i++ {
+		w, h := 14+rr.Intn(7), 12+rr.Intn(5)
+		if opts.Walled {
+			w, h = w+townWallInset*2, h+townWallInset*2
+		}
+		r, ok := findSettlementSite(rr, g, s, settlements, w, h)
+		if !ok {
+			continue
+		}
+		settlements = append(settlements, r)
+		g.rectangle(r, grass, true)
+		s.rectangle(r, nothing, true)
+		buildings, exits := addVillage(rr, m, exportFunc, g, s, f, r, buildingPadding, false, opts.Walled)
+		if len(buildings) == 0 {
+			continue
+		} else if len(exits) == 0 {
+			exits = []vec2{villageNode(g, s, r)}
+		}
+		// Roads connect to each of the gates of walled villages
+		for range exits {
+			groups = append(groups, len(settlements)-1)
+		}
+		nodes = append(nodes, exits...)
+	}
+
+	// Landmarks - dungeon entrances, reached from the tile below
+	for i := 0; i < numLandmarks; i++ {
+		r, ok := findSettlementSite(rr, g, s, settlements, 3, 3)
+		if !ok {
+			continue
+		}
+		settlements = append(settlements, r)
+		x, y := r.x+1, r.y+1
+		g.setTile(x, y, grass)
+		s.setTile(x, y, stairsDown)
+		g.setTile(x, y+1, grass)
+		s.setTile(x, y+1, nothing)
+		nodes = append(nodes, vec2{x, y + 1})
+		groups = append(groups, len(settlements)-1)
+	}
+	exportFunc(m)
+
+	addRoads(m, exportFunc, g, s, nodes, groups)
+
+	return m
+}
+
+// Find an area of mostly passable land without water, away from other
+// settlements
+func findSettlementSite(rr *rand.Rand, g, s *Layer, settlements []rect, w, h int) (rect, bool) {
+	const padding = 4
+	for i := 0; i < 100; i++ {
+		if g.Width-w-2 <= 0 || g.Height-h-2 <= 0 {
+			break
+		}
+		r := rect{rr.Intn(g.Width-w-2) + 1, rr.Intn(g.Height-h-2) + 1, w, h}
+		padded := rect{r.x - padding, r.y - padding, r.w + padding*2, r.h + padding*2}
+		overlaps := false
+		for _, other := range settlements {
+			if padded.Overlaps(other) {
+				overlaps = true
+				break
+			}
+		}
+		if overlaps {
+			continue
+		}
+		land, wet := 0, false
+		for y := r.y; y < r.y+r.h; y++ {
+			for x := r.x; x < r.x+r.w; x++ {
+				wet = wet || g.getTile(x, y) == water
+				if s.getTile(x, y) != mountain {
+					land++
+				}
+			}
+		}
+		if !wet && land*10 >= r.w*r.h*9 {
+			return r, true
+		}
+	}
+	return rect{}, false
+}
+
+// The path tile closest to the centre of a village
+func villageNode(g, s *Layer, r rect) vec2 {
+	cx, cy := r.x+r.w/2, r.y+r.h/2
+	node := vec2{cx, cy}
+	best := -1
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
+			t := g.getTile(x, y)
+			if s.getTile(x, y) != nothing || (t != grass && t != road && t != road2) {
+				continue
+			}
+			d := manhattanDistance(x, y, cx, cy)
+			// Prefer paths over open grass
+			if t == grass {
+				d += r.w + r.h
+			}
+			if best < 0 || d < best {
+				best = d
+				node = vec2{x, y}
+			}
+		}
+	}
+	return node
+}
+
+type roadEdge struct {
+	a, b     int
+	distance float64
+}
+
+// Connect nodes with roads; nodes in the same group, such as the gates of a
+// town, are connected already
+func addRoads(m *Map, exportFunc func(*Map), g, s *Layer, nodes []vec2, groups []int) {
+	if len(nodes) < 2 {
+		return
+	}
+	var edges []roadEdge
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			if groups[i] == groups[j] {
+				continue
+			}
+			edges = append(edges, roadEdge{i, j,
+				euclideanDistance(nodes[i].x, nodes[i].y, nodes[j].x, nodes[j].y)})
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].distance < edges[j].distance
+	})
+	// Minimum spanning tree, then a few of the shortest remaining edges to
+	// form loops
+	var network, extra []roadEdge
+	d := newDisjointSet(len(nodes))
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			if groups[i] == groups[j] {
+				d.union(i, j)
+			}
+		}
+	}
+	for _, e := range edges {
+		if d.union(e.a, e.b) {
+			network = append(network, e)
+		} else if len(extra) < (len(nodes)+2)/3 {
+			extra = append(extra, e)
+		}
+	}
+	network = append(network, extra...)
+
+	world := newRegionWorld(g, s)
+	for _, e := range network {
+		a, b := nodes[e.a], nodes[e.b]
+		path, _, found := astar.Path(world.tile(a.x, a.y), world.tile(b.x, b.y))
+		if !found {
+			continue
+		}
+		for _, t := range path {
+			world.incUsage(t.(*regionTile).x, t.(*regionTile).y)
+		}
+		placeRoads(g, s, world)
+		exportFunc(m)
+	}
+}
+
+func placeRoads(g, s *Layer, world regionWorld) {
+	// Grade roads by traffic; don't downgrade village paths
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			usage := world.getUsage(x, y)
+			if usage == 0 {
+				continue
+			}
+			if s.getTile(x, y) == tree || s.getTile(x, y) == hill {
+				s.setTile(x, y, nothing)
+			}
+			switch g.getTile(x, y) {
+			case water, bridge:
+				g.setTile(x, y, bridge)
+			case road2:
+			default:
+				if usage >= 2 {
+					g.setTile(x, y, road2)
+				} else {
+					g.setTile(x, y, road)
+				}
+			}
+		}
+	}
+}
+
+// Special tile types for A* to find roads over terrain
+type regionTile struct {
+	x, y  int
+	w     regionWorld
+	usage int
+}
+
+func (t *regionTile) PathNeighbors() []astar.Pather {
+	neighbors := []astar.Pather{}
+	for _, offset := range [][]int{
+		{-1, 0},
+		{1, 0},
+		{0, -1},
+		{0, 1},
+	} {
+		n := t.w.tile(t.x+offset[0], t.y+offset[1])
+		if n != nil && n.terrainCost() > 0 {
+			neighbors = append(neighbors, n)
+		}
+	}
+	return neighbors
+}
+
+func (t *regionTile) PathNeighborCost(to astar.Pather) float64 {
+	toT := to.(*regionTile)
+	// Used roads are cheaper, as with village paths
+	return toT.terrainCost() * (0.5/float64(toT.usage+1) + 1)
+}
+
+func (t *regionTile) PathEstimatedCost(to astar.Pather) float64 {
+	toT := to.(*regionTile)
+	return euclideanDistance(t.x, t.y, toT.x, toT.y)
+}
+
+// Cost of travelling over a tile, or 0 if impassable
+func (t *regionTile) terrainCost() float64 {
+	cost := 0.0
+	switch t.w.g.getTile(t.x, t.y) {
+	case road, road2, bridge:
+		cost = 1
+	case grass:
+		cost = 2
+	case sand:
+		cost = 3
+	case water:
+		cost = 24
+	default:
+		return 0
+	}
+	switch t.w.s.getTile(t.x, t.y) {
+	case nothing:
+	case tree:
+		cost += 4
+	case hill:
+		cost += 8
+	default:
+		// Mountains and buildings
+		return 0
+	}
+	return cost
+}
+
+type regionWorld struct {
+	g, s  *Layer
+	tiles []*regionTile
+}
+
+func newRegionWorld(g, s *Layer) regionWorld {
+	world := regionWorld{g, s, make([]*regionTile, g.Width*g.Height)}
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			world.tiles[x+y*g.Width] = &regionTile{x, y, world, 0}
+		}
+	}
+	return world
+}
+
+func (w regionWorld) tile(x, y int) *regionTile {
+	if !w.g.isIn(x, y) {
+		return nil
+	}
+	return w.tiles[x+y*w.g.Width]
+}
+
+func (w regionWorld) incUsage(x, y int) {
+	w.tile(x, y).usage++
+}
+
+func (w regionWorld) getUsage(x, y int) int {
+	return w.tile(x, y).usage
+}
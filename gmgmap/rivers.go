@@ -0,0 +1,161 @@
+package gmgmap
+
+import (
+	"container/heap"
+	"math/rand"
+)
+
+// Rivers widen by one tile either side after flowing this far
+const riverWideningLength = 12
+
+// AddRivers - add rivers and lakes to an outdoor map without terrain, using
+// a noise elevation field with features of roughly featureSize tiles.
+// Rivers start at high sources and flow downhill until they reach the map
+// edge or other water. Where a river is stuck in a basin, it fills into a lake
+// until it can flow out again.
+// Rivers widen with distance, and bridges are placed where they cross roads.
+// Buildings are treated as obstacles.
+func AddRivers(rr *rand.Rand, m *Map, numRivers, featureSize int) {
+	featureSize = imax(featureSize, 1)
+	elevation := noiseField(rr, m.Width, m.Height, float64(featureSize), 4)
+	addRivers(rr, m, numRivers, elevation, featureSize)
+}
+
+// Add rivers flowing over an elevation field
+func addRivers(rr *rand.Rand, m *Map, numRivers int, elevation []float64, featureSize int) {
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+
+	// Pick sources from the highest land
+	var sources []int
+	for i, e := range elevation {
+		if e > 0.7 && canFlowInto(g, s, i) && g.Tiles[i] != water {
+			sources = append(sources, i)
+		}
+	}
+	rr.Shuffle(len(sources), func(i, j int) {
+		sources[i], sources[j] = sources[j], sources[i]
+	})
+	for i := 0; i < numRivers && i < len(sources); i++ {
+		path, lakes := flowRiver(g, s, elevation, sources[i], featureSize*featureSize/2)
+		// Widen rivers with distance
+		for j, tile := range path {
+			r := imin(j/riverWideningLength, 2)
+			x, y := tile%m.Width, tile/m.Width
+			for yi := y - r; yi <= y+r; yi++ {
+				for xi := x - r; xi <= x+r; xi++ {
+					if g.isIn(xi, yi) && manhattanDistance(x, y, xi, yi) <= r {
+						addWater(g, s, xi+yi*m.Width)
+					}
+				}
+			}
+		}
+		for _, tile := range lakes {
+			addWater(g, s, tile)
+		}
+	}
+}
+
+// Trace a river downhill from a source.
+// Returns the tiles along the river's course, and the tiles of any lakes.
+func flowRiver(g, s *Layer, elevation []float64, source, maxLakeSize int) ([]int, []int) {
+	visited := map[int]bool{source: true}
+	var path, lakes []int
+	isEnd := func(i int) bool {
+		x, y := i%g.Width, i/g.Width
+		return g.Tiles[i] == water || x == 0 || y == 0 ||
+			x == g.Width-1 || y == g.Height-1
+	}
+	current := source
+	for {
+		path = append(path, current)
+		if current != source && isEnd(current) {
+			break
+		}
+		// Flow to the lowest neighbour
+		next := -1
+		for _, j := range g.neighbourIndices(current) {
+			if visited[j] || !canFlowInto(g, s, j) {
+				continue
+			}
+			if next < 0 || elevation[j] < elevation[next] {
+				next = j
+			}
+		}
+		if next < 0 {
+			break
+		}
+		if elevation[next] >= elevation[current] {
+			// Stuck in a basin; fill it with a lake until we find an outlet,
+			// i.e. a tile on the shore lower than the lake surface
+			lake, outlet := fillLake(g, s, elevation, visited, current, maxLakeSize, isEnd)
+			lakes = append(lakes, lake...)
+			if outlet < 0 {
+				break
+			}
+			next = outlet
+		}
+		visited[next] = true
+		current = next
+	}
+	return path, lakes
+}
+
+// Fill a lake from a tile, by repeatedly flooding the lowest tile on the shore
+// Returns the lake tiles and the outlet, or -1 if the lake is full
+func fillLake(g, s *Layer, elevation []float64, visited map[int]bool, start, maxSize int, isEnd func(int) bool) ([]int, int) {
+	lake := []int{start}
+	level := elevation[start]
+	shore := &tileHeap{}
+	addShore := func(i int) {
+		for _, j := range g.neighbourIndices(i) {
+			if !visited[j] && canFlowInto(g, s, j) {
+				heap.Push(shore, tilePriority{elevation[j], j % g.Width, j / g.Width})
+			}
+		}
+	}
+	addShore(start)
+	for shore.Len() > 0 && len(lake) < maxSize {
+		t := heap.Pop(shore).(tilePriority)
+		i := t.x + t.y*g.Width
+		if visited[i] {
+			continue
+		}
+		if t.priority < level || isEnd(i) {
+			return lake, i
+		}
+		visited[i] = true
+		level = t.priority
+		lake = append(lake, i)
+		addShore(i)
+	}
+	return lake, -1
+}
+
+// Whether water can be placed on a tile; buildings and their surroundings
+// are obstacles
+func canFlowInto(g, s *Layer, i int) bool {
+	switch s.Tiles[i] {
+	case nothing, tree, hill, mountain:
+	default:
+		return false
+	}
+	switch g.Tiles[i] {
+	case grass, floor, sand, road, road2, water, bridge:
+		return true
+	}
+	return false
+}
+
+func addWater(g, s *Layer, i int) {
+	if !canFlowInto(g, s, i) {
+		return
+	}
+	s.Tiles[i] = nothing
+	switch g.Tiles[i] {
+	case road, road2, bridge:
+		g.Tiles[i] = bridge
+	default:
+		g.Tiles[i] = water
+	}
+}
@@ -188,42 +188,7 @@ func NewRogue(rr *rand.Rand, width, height,
 		}
 	}
 
-	// Find door tiles: those with 2 neighbour walls and 1 each of corridor/room
-	for y := 0; y < m.Height; y++ {
-		for x := 0; x < m.Width; x++ {
-			if IsWall(s.getTile(x, y)) {
-				continue
-			}
-			walls, corridors, rooms := 0, 0, 0
-			var countTile = func(x, y int) {
-				if IsWall(s.getTile(x, y)) {
-					walls++
-				} else {
-					switch g.getTile(x, y) {
-					case room:
-						rooms++
-					case room2:
-						corridors++
-					}
-				}
-			}
-			if y > 0 {
-				countTile(x, y-1)
-			}
-			if x < m.Width-1 {
-				countTile(x+1, y)
-			}
-			if y < m.Height-1 {
-				countTile(x, y+1)
-			}
-			if x > 0 {
-				countTile(x-1, y)
-			}
-			if walls == 2 && corridors == 1 && rooms == 1 {
-				s.setTile(x, y, door)
-			}
-		}
-	}
+	addDoors(g, s, room, room2)
 
 	// Put stairs in the first and last room
 	firstRoom := rooms[firstRoomIndex]
@@ -0,0 +1,265 @@
+package gmgmap
+
+import "fmt"
+
+// KeyInfo - a key found when checking solvability
+type KeyInfo struct {
+	X, Y      int
+	Colour    string
+	Reachable bool
+	Used      bool
+}
+
+// LockInfo - a locked door found when checking solvability.
+// Gated is the number of tiles that can only be reached by opening this lock,
+// within the bounding box GatedX/Y/Width/Height.
+type LockInfo struct {
+	X, Y        int
+	Colour      string
+	Opened      bool
+	Gated       int
+	GatedX      int
+	GatedY      int
+	GatedWidth  int
+	GatedHeight int
+	GatesGoal   bool
+}
+
+// Solvability - the result of checking whether a map can be completed
+type Solvability struct {
+	Solvable bool
+	Keys     []KeyInfo
+	Locks    []LockInfo
+}
+
+// CheckSolvability - check whether a map with locked doors and keys can be
+// completed, regardless of which generator made it.
+// Exploration starts from the stairs up (or player), picking up any keys
+// that can be reached, and opening locked doors that they fit, trying each
+// choice of which door to open with keys that can only be used once, until
+// the stairs down are reached or there's nothing more to open.
+// One-way doors are only passed through in the direction recorded in their
+// map objects, and secret doors are walked through as if they've been found.
+// Keys and locks are matched by the colours recorded in the map objects;
+// a coloured key opens every lock of its colour. Keys without colours open
+// one lock each, without a colour.
+func CheckSolvability(m *Map) Solvability {
+	ag := newAreaGraph(m)
+	s := m.Layer("Structures")
+	start := ag.findArea(m, stairsUp)
+	if start < 0 {
+		start = ag.findArea(m, player)
+	}
+	goal := ag.findArea(m, stairsDown)
+
+	colourAt := func(objectType string, x, y int) string {
+		for _, o := range m.Objects {
+			if o.Type == objectType && o.X == x && o.Y == y {
+				return o.Properties["colour"]
+			}
+		}
+		return ""
+	}
+	var sv Solvability
+	var keyAreas []int
+	for _, l := range m.Layers {
+		for i, t := range l.Tiles {
+			if t == key {
+				x, y := i%m.Width, i/m.Width
+				sv.Keys = append(sv.Keys, KeyInfo{x, y, colourAt("key", x, y), false, false})
+				keyAreas = append(keyAreas, ag.areas[i])
+			}
+		}
+	}
+	lockOf := make([]int, len(ag.doorways))
+	var lockDoorways []int
+	for d, dw := range ag.doorways {
+		lockOf[d] = -1
+		for _, i := range dw.tiles {
+			if s.Tiles[i] == doorLocked {
+				x, y := i%m.Width, i/m.Width
+				lockOf[d] = len(sv.Locks)
+				lockDoorways = append(lockDoorways, d)
+				sv.Locks = append(sv.Locks, LockInfo{X: x, Y: y, Colour: colourAt("lock", x, y)})
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return sv
+	}
+
+	// Search over which locks to open: coloured keys can be used again, so
+	// their locks are opened as soon as they can be, but keys without colours
+	// are used up, and could be wasted on the wrong lock, so try each choice.
+	// Returns the areas that can be reached by any choice (or -1), and the
+	// locks opened by a choice that reaches the goal, or otherwise the one
+	// that reaches the most areas.
+	explore := func(closed int) ([]int, []bool) {
+		union := make([]int, ag.numAreas)
+		for i := range union {
+			union[i] = -1
+		}
+		var best []bool
+		bestSolved, bestCount := false, -1
+		seen := map[string]bool{}
+		var visit func(opened []bool)
+		visit = func(opened []bool) {
+			isOpen := func(d int) bool {
+				return lockOf[d] < 0 || opened[lockOf[d]]
+			}
+			canOpen := func(l int, reachable []int) bool {
+				return !opened[l] && l != closed && ag.doorways[lockDoorways[l]].isReachable(reachable)
+			}
+			var reachable []int
+			for changed := true; changed; {
+				reachable, _ = ag.search(start, isOpen)
+				changed = false
+				for l := range sv.Locks {
+					if sv.Locks[l].Colour == "" || !canOpen(l, reachable) {
+						continue
+					}
+					for k, area := range keyAreas {
+						if area >= 0 && reachable[area] >= 0 && sv.Keys[k].Colour == sv.Locks[l].Colour {
+							opened[l] = true
+							changed = true
+							break
+						}
+					}
+				}
+			}
+			state := fmt.Sprint(opened)
+			if seen[state] {
+				return
+			}
+			seen[state] = true
+			count := 0
+			for area, distance := range reachable {
+				if distance >= 0 {
+					union[area] = 0
+					count++
+				}
+			}
+			solved := goal >= 0 && reachable[goal] >= 0
+			if (solved && !bestSolved) || (solved == bestSolved && count > bestCount) {
+				best = append([]bool{}, opened...)
+				bestSolved, bestCount = solved, count
+			}
+			// Spare keys without colours, to try on each lock they fit
+			spare := 0
+			for k, area := range keyAreas {
+				if area >= 0 && reachable[area] >= 0 && sv.Keys[k].Colour == "" {
+					spare++
+				}
+			}
+			for l := range sv.Locks {
+				if opened[l] && sv.Locks[l].Colour == "" {
+					spare--
+				}
+			}
+			for l := range sv.Locks {
+				if spare > 0 && sv.Locks[l].Colour == "" && canOpen(l, reachable) {
+					next := append([]bool{}, opened...)
+					next[l] = true
+					visit(next)
+				}
+			}
+		}
+		visit(make([]bool, len(sv.Locks)))
+		return union, best
+	}
+
+	// Explore with every lock available, then with each lock kept closed, to
+	// find which tiles each lock gates
+	reachable, opened := explore(-1)
+	sv.Solvable = goal >= 0 && reachable[goal] >= 0
+	for k, area := range keyAreas {
+		sv.Keys[k].Reachable = area >= 0 && reachable[area] >= 0
+	}
+	// Match the opened locks with keys that fit
+	for l := range sv.Locks {
+		if !opened[l] {
+			continue
+		}
+		sv.Locks[l].Opened = true
+		for k := range sv.Keys {
+			if sv.Keys[k].Reachable && sv.Keys[k].Colour == sv.Locks[l].Colour &&
+				(sv.Keys[k].Colour != "" || !sv.Keys[k].Used) {
+				sv.Keys[k].Used = true
+				break
+			}
+		}
+	}
+	for l := range sv.Locks {
+		without, _ := explore(l)
+		x1, y1, x2, y2 := m.Width, m.Height, -1, -1
+		for i, area := range ag.areas {
+			if area < 0 || reachable[area] < 0 || without[area] >= 0 {
+				continue
+			}
+			x, y := i%m.Width, i/m.Width
+			x1, y1 = imin(x1, x), imin(y1, y)
+			x2, y2 = imax(x2, x), imax(y2, y)
+			sv.Locks[l].Gated++
+		}
+		if sv.Locks[l].Gated > 0 {
+			sv.Locks[l].GatedX, sv.Locks[l].GatedY = x1, y1
+			sv.Locks[l].GatedWidth, sv.Locks[l].GatedHeight = x2-x1+1, y2-y1+1
+		}
+		sv.Locks[l].GatesGoal = sv.Solvable && without[goal] < 0
+	}
+	return sv
+}
+
+func (dw doorway) isReachable(reachable []int) bool {
+	for _, area := range dw.areas {
+		if reachable[area] >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UnusedKeys - keys that don't open any locks, including unreachable keys
+func (sv Solvability) UnusedKeys() []KeyInfo {
+	var keys []KeyInfo
+	for _, k := range sv.Keys {
+		if !k.Used {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Print - print a summary of the solvability check
+func (sv Solvability) Print() {
+	fmt.Println("Solvable:", sv.Solvable)
+	for _, l := range sv.Locks {
+		status := "opened"
+		if !l.Opened {
+			status = "not opened"
+		}
+		fmt.Printf("%s at %d,%d: %s, gates %d tiles", describeLock("Lock", l.Colour), l.X, l.Y, status, l.Gated)
+		if l.Gated > 0 {
+			fmt.Printf(" in %d,%d %dx%d", l.GatedX, l.GatedY, l.GatedWidth, l.GatedHeight)
+		}
+		if l.GatesGoal {
+			fmt.Print(", including the goal")
+		}
+		fmt.Println()
+	}
+	for _, k := range sv.UnusedKeys() {
+		status := "unused"
+		if !k.Reachable {
+			status = "unreachable"
+		}
+		fmt.Printf("%s at %d,%d: %s\n", describeLock("Key", k.Colour), k.X, k.Y, status)
+	}
+}
+
+func describeLock(name, colour string) string {
+	if colour == "" {
+		return name
+	}
+	return name + " " + colour
+}
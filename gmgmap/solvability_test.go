@@ -0,0 +1,111 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Build a map from rows of tiles: spaces are empty, keys and the player go
+// on the Characters layer, and everything else is a structure on floor
+func mapFromRows(rows ...string) *Map {
+	m := NewMap(len(rows[0]), len(rows))
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	c := m.Layer("Characters")
+	for y, row := range rows {
+		for x, t := range row {
+			switch t {
+			case nothing:
+				continue
+			case key, player:
+				c.setTile(x, y, t)
+			case room:
+			default:
+				s.setTile(x, y, t)
+			}
+			g.setTile(x, y, room)
+		}
+	}
+	return m
+}
+
+func TestCheckSolvabilityDoors(t *testing.T) {
+	tests := []struct {
+		name      string
+		door      rune
+		direction string
+		solvable  bool
+	}{
+		{"door", door, "", true},
+		{"secret door", doorSecret, "", true},
+		{"one-way door", doorOneWay, "right", true},
+		{"one-way door the wrong way", doorOneWay, "left", false},
+		{"one-way door without direction", doorOneWay, "", true},
+		{"locked door without key", doorLocked, "", false},
+	}
+	for _, test := range tests {
+		m := mapFromRows("<." + string(test.door) + ".>")
+		if test.direction != "" {
+			m.AddObject("Door", "shortcut", 2, 0, 1, 1, map[string]string{"direction": test.direction})
+		}
+		if sv := CheckSolvability(m); sv.Solvable != test.solvable {
+			t.Errorf("%s: solvable = %v, want %v", test.name, sv.Solvable, test.solvable)
+		}
+	}
+}
+
+func TestCheckSolvabilityKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     []string
+		colours  map[int]string
+		solvable bool
+		unused   int
+	}{
+		{"key before lock", []string{"<(x.>"}, nil, true, 0},
+		{"key behind lock", []string{"<.x(>"}, nil, false, 1},
+		// One key for two locks: spending it on the dead end strands the goal
+		{"key spent on the right lock", []string{
+			"<(.x>",
+			"WW+WW",
+			"WWxWW",
+			"WW.WW",
+		}, nil, true, 0},
+		{"coloured key opens every lock", []string{"<(x.x>"}, map[int]string{1: "red", 2: "red", 4: "red"}, true, 0},
+		{"coloured key doesn't fit", []string{"<(x.>"}, map[int]string{1: "red", 2: "blue"}, false, 1},
+	}
+	for _, test := range tests {
+		m := mapFromRows(test.rows...)
+		for x, colour := range test.colours {
+			objectType := "lock"
+			if test.rows[0][x] == byte(key) {
+				objectType = "key"
+			}
+			m.AddObject("", objectType, x, 0, 1, 1, map[string]string{"colour": colour})
+		}
+		sv := CheckSolvability(m)
+		if sv.Solvable != test.solvable || len(sv.UnusedKeys()) != test.unused {
+			t.Errorf("%s: solvable = %v with %d unused keys, want %v with %d",
+				test.name, sv.Solvable, len(sv.UnusedKeys()), test.solvable, test.unused)
+		}
+	}
+}
+
+func TestAddLocksAndKeys(t *testing.T) {
+	// There are two ways down, so none of the doors need to be opened
+	m := mapFromRows(
+		"<.+.+.>",
+		"W.WWW.W",
+		"W.+.+.W",
+	)
+	if n := AddLocksAndKeys(rand.New(rand.NewSource(1)), m, 5); n != 0 {
+		t.Errorf("locked %d doors with a way around them", n)
+	}
+	m = mapFromRows("<.+.*./.>")
+	if n := AddLocksAndKeys(rand.New(rand.NewSource(1)), m, 5); n != 1 {
+		t.Errorf("locked %d doors, want only the ordinary door", n)
+	}
+	if sv := CheckSolvability(m); !sv.Solvable {
+		t.Error("locks and keys are not solvable")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"text/template"
 )
@@ -22,6 +23,35 @@ type csvExport struct {
 	Values string
 }
 
+// DTO for object export
+type objectExport struct {
+	ID         int
+	Name       string
+	Type       string
+	X          int
+	Y          int
+	Width      int
+	Height     int
+	Properties []propertyExport
+}
+
+type propertyExport struct {
+	Name  string
+	Value string
+}
+
+// DTO for a group of layers
+type groupExport struct {
+	Name   string
+	Hidden bool
+	CSVs   []csvExport
+}
+
+// Size of tiles in pixels, for object export
+const tmxTileSize = 16
+
+const tmxExportDir = "tmx_export"
+
 // TMXTemplate - configuration for TMX export
 type TMXTemplate struct {
 	path       string
@@ -55,10 +85,20 @@ type TMXTemplate struct {
 	// isolated
 	treeIDs  [16]string
 	grassIDs [16]string
+	// Cave materials, same tiling as floors
+	waterIDs  [16]string
+	lavaIDs   [16]string
+	chasmIDs  [16]string
+	bridgeIDs [16]string
+	sandIDs   [16]string
+	// Overworld features - randomly chosen
+	hillIDs     []string
+	mountainIDs []string
 
 	// Flavour tiles - randomly chosen
 	signIDs       []string
-	wallSignIDs   []string // signs that hang off walls TODO: by shop type
+	wallSignIDs   []string          // signs that hang off walls
+	typeSignIDs   map[string]string // wall signs by building sign
 	hangingIDs    []string
 	windowIDs     []string
 	counterHIDs   [3]string // 3 IDs, left middle end
@@ -74,16 +114,47 @@ type TMXTemplate struct {
 	playerIDs     []string
 	flowerIDs     []string
 	keyIDs        []string
+	// Outdoor features; fences use the same tiling as floors
+	fenceIDs [16]string
+	cropIDs  []string
+	wellIDs  []string
+	graveIDs []string
 
 	// Parameters used for template export
-	Width  int
-	Height int
-	CSVs   []csvExport
+	Width   int
+	Height  int
+	CSVs    []csvExport
+	Objects []objectExport
+	Groups  []groupExport
+}
+
+// The sign of the building at a tile, as recorded in its map object
+func buildingSign(m Map, x, y int) string {
+	for _, o := range m.Objects {
+		if o.Type == "building" && x >= o.X && y >= o.Y && x < o.X+o.Width && y < o.Y+o.Height {
+			return o.Properties["sign"]
+		}
+	}
+	return ""
 }
 
 // ToTMX - export map as TMX (Tiled XML map)
 func (m Map) ToTMX(rr *rand.Rand, tmxTemplate *TMXTemplate, imgId int) error {
-	exportDir := "tmx_export"
+	return m.toTMX(rr, tmxTemplate, imgId, "map.tmx")
+}
+
+func (m Map) toTMX(rr *rand.Rand, tmxTemplate *TMXTemplate, imgId int, filename string) error {
+	// Avoid generating many layers with the same name in one map.tmx file.
+	tmxTemplate.CSVs = make([]csvExport, 0)
+	tmxTemplate.Objects = make([]objectExport, 0)
+	tmxTemplate.Groups = make([]groupExport, 0)
+	populateTemplate(rr, m, tmxTemplate)
+	return exportTMX(tmxTemplate, imgId, filename)
+}
+
+// Write a populated template as TMX, along with its data files
+func exportTMX(tmxTemplate *TMXTemplate, imgId int, filename string) error {
+	exportDir := tmxExportDir
 	err := os.Mkdir(exportDir, 0755)
 	if err != nil && !os.IsExist(err) {
 		log.Fatal(err)
@@ -127,17 +198,13 @@ func (m Map) ToTMX(rr *rand.Rand, tmxTemplate *TMXTemplate, imgId int) error {
 	if err != nil {
 		return err
 	}
-	// Avoid generating many layers with the same name in one map.tmx file.
-	tmxTemplate.CSVs = make([]csvExport, 0)
-	populateTemplate(rr, m, tmxTemplate)
-
 	// Generate TMX
 	// Use template path as template name
 	t, err := template.ParseFiles(path.Join(baseDir, "template.tmx"))
 	if err != nil {
 		return err
 	}
-	outPath := path.Join(exportDir, "map.tmx")
+	outPath := path.Join(exportDir, filename)
 	outFile, err := os.Create(outPath)
 	if err != nil {
 		return err
@@ -203,7 +270,7 @@ func populateTemplate(rr *rand.Rand, m Map, tmp *TMXTemplate) {
 					tileIDs = &tmp.roomIDs
 				case room2:
 					tileIDs = &tmp.room2IDs
-				case door:
+				case door, doorOneWay:
 					left := wall
 					if x > 0 {
 						left = wallLayer.getTile(x-1, y)
@@ -223,6 +290,9 @@ func populateTemplate(rr *rand.Rand, m Map, tmp *TMXTemplate) {
 					} else {
 						xt[x+y*l.Width] = tmp.doorLockedV
 					}
+				case doorSecret:
+					// Secret doors look like the walls around them
+					xt[x+y*l.Width] = get16Tile(m, x, y, wall2, &tmp.wall2IDs)
 				case stairsUp:
 					xt[x+y*l.Width] = tmp.stairsUp
 				case stairsDown:
@@ -231,9 +301,25 @@ func populateTemplate(rr *rand.Rand, m Map, tmp *TMXTemplate) {
 					xt[x+y*l.Width] = get16Tile2(m, x, y, tile, &tmp.treeIDs)
 				case grass:
 					tileIDs = &tmp.grassIDs
+				case water:
+					tileIDs = &tmp.waterIDs
+				case lava:
+					tileIDs = &tmp.lavaIDs
+				case chasm:
+					tileIDs = &tmp.chasmIDs
+				case bridge:
+					tileIDs = &tmp.bridgeIDs
+				case sand:
+					tileIDs = &tmp.sandIDs
+				case hill:
+					xt[x+y*l.Width] = tmp.hillIDs[rr.Intn(len(tmp.hillIDs))]
+				case mountain:
+					xt[x+y*l.Width] = tmp.mountainIDs[rr.Intn(len(tmp.mountainIDs))]
 				case sign:
 					// choose from on-wall sign or stand-alone sign
-					if IsWall(wallLayer.getTile(x, y)) {
+					if id, ok := tmp.typeSignIDs[buildingSign(m, x, y)]; ok && IsWall(wallLayer.getTile(x, y)) {
+						xt[x+y*l.Width] = id
+					} else if IsWall(wallLayer.getTile(x, y)) {
 						xt[x+y*l.Width] = tmp.wallSignIDs[rr.Intn(len(tmp.wallSignIDs))]
 					} else {
 						xt[x+y*l.Width] = tmp.signIDs[rr.Intn(len(tmp.signIDs))]
@@ -288,6 +374,14 @@ func populateTemplate(rr *rand.Rand, m Map, tmp *TMXTemplate) {
 					xt[x+y*l.Width] = tmp.flowerIDs[rr.Intn(len(tmp.flowerIDs))]
 				case key:
 					xt[x+y*l.Width] = tmp.keyIDs[rr.Intn(len(tmp.keyIDs))]
+				case fence:
+					tileIDs = &tmp.fenceIDs
+				case crop:
+					xt[x+y*l.Width] = tmp.cropIDs[rr.Intn(len(tmp.cropIDs))]
+				case well:
+					xt[x+y*l.Width] = tmp.wellIDs[rr.Intn(len(tmp.wellIDs))]
+				case grave:
+					xt[x+y*l.Width] = tmp.graveIDs[rr.Intn(len(tmp.graveIDs))]
 				default:
 					fmt.Println("Unhandled tile", tile)
 					panic(tile)
@@ -311,6 +405,18 @@ func populateTemplate(rr *rand.Rand, m Map, tmp *TMXTemplate) {
 	for _, l := range m.Layers {
 		tmp.CSVs = append(tmp.CSVs, makeCSV(l, m.Layer("Structures")))
 	}
+	for i, o := range m.Objects {
+		var properties []propertyExport
+		for name, value := range o.Properties {
+			properties = append(properties, propertyExport{name, value})
+		}
+		sort.Slice(properties, func(i, j int) bool {
+			return properties[i].Name < properties[j].Name
+		})
+		tmp.Objects = append(tmp.Objects, objectExport{i + 1, o.Name, o.Type,
+			o.X * tmxTileSize, o.Y * tmxTileSize,
+			o.Width * tmxTileSize, o.Height * tmxTileSize, properties})
+	}
 }
 
 func get16Tile(m Map, x, y int, tile rune, templateTiles *[16]string) string {
@@ -437,7 +543,7 @@ func hasSameTile(m Map, x, y int, tile rune) bool {
 		t := l.getTile(x, y)
 		if t == tile {
 			return true
-		} else if IsWall(tile) && (IsWall(t) || t == door) {
+		} else if IsWall(tile) && (IsWall(t) || IsDoor(t) || t == doorSecret) {
 			return true
 		}
 	}
@@ -26,8 +26,20 @@ var DawnLikeTemplate = TMXTemplate{
 	[16]string{"2537", "2525", "2526", "2538", "2550", "2549", "2548", "2536", "2524", "2540", "2528", "2529", "2541", "2553", "2552", "2527"},
 	// Grass
 	[16]string{"1176", "1155", "1156", "1177", "1198", "1197", "1196", "1175", "1154", "1180", "1178", "1157", "1181", "1199", "1179", "1159"},
+	// Water, lava and chasm use pits, which have no bottom edges
+	[16]string{"1977", "1969", "1970", "1978", "1978", "1977", "1976", "1976", "1968", "1969", "1980", "1972", "1970", "1980", "1968", "1972"},
+	[16]string{"2057", "2049", "2050", "2058", "2058", "2057", "2056", "2056", "2048", "2049", "2060", "2052", "2050", "2060", "2048", "2052"},
+	[16]string{"1865", "1857", "1858", "1866", "1866", "1865", "1864", "1864", "1856", "1857", "1868", "1860", "1858", "1868", "1856", "1860"},
+	// Bridge
+	[16]string{"1610", "1589", "1590", "1611", "1632", "1631", "1630", "1609", "1588", "1614", "1612", "1591", "1615", "1633", "1613", "1593"},
+	// Sand
+	[16]string{"1358", "1337", "1338", "1359", "1380", "1379", "1378", "1357", "1336", "1362", "1360", "1339", "1363", "1381", "1361", "1341"},
+	// Hills, mountains
+	[]string{"5171", "5175"},
+	[]string{"5219", "5223", "5227"},
 	[]string{"2177", "2178", "2181", "2182"},
 	[]string{"2185", "2186", "2187", "2188", "2189", "2190", "2191"},
+	map[string]string{"coin": "2189", "mug": "2185", "anvil": "2187", "banner": "2191"},
 	[]string{"2168", "2169", "2170", "2171", "2172", "2173", "2174", "2200", "2201", "2202", "2203", "2204", "2205", "2206", "2207", "2144", "2148"},
 	[]string{"2144", "2148"},
 	[3]string{"2216", "2217", "2218"},
@@ -45,7 +57,12 @@ var DawnLikeTemplate = TMXTemplate{
 	[]string{"2328", "2329", "2330", "2331", "2332", "2333", "2334", "2335"},
 	// Keys
 	[]string{"4640", "4641"},
-	0, 0, []csvExport{}}
+	// Fences, crops, wells, graves
+	[16]string{"5444", "5436", "5434", "5445", "5450", "5452", "5448", "5443", "5432", "5433", "5440", "5440", "5433", "5440", "5433", "5441"},
+	[]string{"2312", "2313", "2320", "2321", "2336", "2337"},
+	[]string{"2304"},
+	[]string{"2272", "2273", "2274", "2275", "2280", "2281", "2282", "2283"},
+	0, 0, []csvExport{}, []objectExport{}, []groupExport{}}
 
 // KenneyTemplate - using Kenney's roguelike/RPG pack
 var KenneyTemplate = TMXTemplate{
@@ -72,8 +89,21 @@ var KenneyTemplate = TMXTemplate{
 	[16]string{"403", "346", "347", "404", "461", "460", "459", "402", "345", "344", "401", "400", "343", "403", "403", "403"}, // TODO: diagonals and isolated tile
 	// Grass
 	[16]string{"916", "859", "860", "917", "974", "973", "972", "915", "858", "916", "916", "916", "916", "916", "916", "916"}, // TODO: h/v, ends, isolated
+	// Water, lava
+	[16]string{"61", "4", "5", "62", "119", "118", "117", "60", "3", "61", "61", "61", "61", "61", "61", "1"},                                  // TODO: h/v, ends
+	[16]string{"1087", "1030", "1031", "1088", "1145", "1144", "1143", "1086", "1029", "1087", "1087", "1087", "1087", "1087", "1087", "1087"}, // TODO: h/v, ends, isolated
+	// Chasm
+	[16]string{"151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151", "151"}, // TODO: edges
+	// Bridge
+	[16]string{"1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426", "1426"}, // TODO: no bridges in template
+	// Sand
+	[16]string{"1263", "1206", "1207", "1264", "1321", "1320", "1319", "1262", "1205", "1150", "1093", "1318", "1374", "1317", "1375", "1377"},
+	// Hills, mountains
+	[]string{"1138", "1195"},
+	[]string{"1252"},
 	[]string{"20"},
 	[]string{"17"},
+	map[string]string{}, // TODO: no shop signs in template
 	[]string{"413", "414", "415", "357", "143", "144", "254", "312", "483", "843", "727", "729", "841", "100", "46", "45", "48", "49"},
 	[]string{"330", "331", "332", "333"},
 	[3]string{"2120", "2220", "2121"},
@@ -91,4 +121,9 @@ var KenneyTemplate = TMXTemplate{
 	[]string{"542", "543", "544", "545"},
 	// Keys
 	[]string{"2446"}, // TODO: no keys in template
-	0, 0, []csvExport{}}
+	// Fences, crops, wells, graves
+	[16]string{"1360", "1360", "1361", "1361", "1361", "1360", "1359", "1359", "1359", "1360", "1363", "1363", "1361", "1363", "1359", "1357"}, // TODO: corners
+	[]string{"593", "650", "599", "656"},
+	[]string{"564"},
+	[]string{"565", "566", "567", "622", "623", "624", "679", "680", "681"},
+	0, 0, []csvExport{}, []objectExport{}, []groupExport{}}
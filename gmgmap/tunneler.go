@@ -0,0 +1,183 @@
+package gmgmap
+
+import "math/rand"
+
+const (
+	tunnelerTurnPct = 10
+	maxTunnelers    = 32
+)
+
+type tunneler struct {
+	x, y     int
+	dir      int
+	width    int
+	age      int
+	lifespan int
+}
+
+// NewTunneler - create a dungeon using tunneling agents.
+// Tunnelers start in the middle and dig corridors up to maxCorridorWidth wide,
+// occasionally turning, and spawning child tunnelers (spawnPct) that dig off
+// to the side. Tunnelers die after their lifespan, and children get shorter
+// lifespans than their parents.
+// Rooms are placed at the ends of tunnels, and at turns (roomPct).
+// Doors are placed where corridors meet rooms.
+// Corridors are at least 1 wide.
+func NewTunneler(rr *rand.Rand, exportFunc func(*Map), width, height, lifespan, maxCorridorWidth, spawnPct, roomPct, minRoomSize, maxRoomSize int) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	maxCorridorWidth = imax(maxCorridorWidth, 1)
+
+	// Start with two tunnelers back to back
+	dir := rr.Intn(4)
+	tunnelers := []tunneler{
+		{width / 2, height / 2, dir, rr.Intn(maxCorridorWidth) + 1, 0, lifespan},
+		{width / 2, height / 2, (dir + 2) % 4, rr.Intn(maxCorridorWidth) + 1, 0, lifespan},
+	}
+	numTunnelers := len(tunnelers)
+	for _, t := range tunnelers {
+		t.forEachTile(func(x, y int) {
+			g.setTile(x, y, room2)
+		})
+	}
+	var rooms []rect
+	addRoom := func(t tunneler) {
+		if r, ok := addTunnelerRoom(rr, g, s, t, minRoomSize, maxRoomSize); ok {
+			rooms = append(rooms, r)
+		}
+	}
+	for i := 0; len(tunnelers) > 0; i++ {
+		alive := tunnelers[:0]
+		var children []tunneler
+		for _, t := range tunnelers {
+			if t.age >= t.lifespan {
+				addRoom(t)
+				continue
+			}
+			if rr.Intn(100) < tunnelerTurnPct {
+				if rr.Intn(100) < roomPct {
+					addRoom(t)
+				}
+				t.dir = (t.dir + 1 + rr.Intn(2)*2) % 4
+			}
+			if !canTunnel(g, s, t) {
+				// Try turning either way, otherwise die
+				t.dir = (t.dir + 1 + rr.Intn(2)*2) % 4
+				if !canTunnel(g, s, t) {
+					t.dir = (t.dir + 2) % 4
+					if !canTunnel(g, s, t) {
+						addRoom(t)
+						continue
+					}
+				}
+			}
+			d := walkOffsets[t.dir]
+			t.x, t.y = t.x+d.x, t.y+d.y
+			t.forEachTile(func(x, y int) {
+				g.setTile(x, y, room2)
+			})
+			t.age++
+			if numTunnelers < maxTunnelers && rr.Intn(100) < spawnPct {
+				children = append(children, tunneler{t.x, t.y,
+					(t.dir + 1 + rr.Intn(2)*2) % 4, rr.Intn(maxCorridorWidth) + 1,
+					0, (t.lifespan - t.age) / 2})
+				numTunnelers++
+			}
+			alive = append(alive, t)
+		}
+		tunnelers = append(alive, children...)
+		if i%5 == 0 {
+			exportFunc(m)
+		}
+	}
+
+	addDoors(g, s, room, room2)
+	exportFunc(m)
+
+	// Put stairs in the first and last room; without enough rooms, use where
+	// the tunnels started, and the corridor furthest from the up stairs
+	up := vec2{width / 2, height / 2}
+	if len(rooms) > 0 {
+		up = vec2{rooms[0].x + rooms[0].w/2, rooms[0].y + rooms[0].h/2}
+	}
+	down := up
+	if len(rooms) > 1 {
+		lastRoom := rooms[len(rooms)-1]
+		down = vec2{lastRoom.x + lastRoom.w/2, lastRoom.y + lastRoom.h/2}
+	} else {
+		best := 0
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				d := manhattanDistance(x, y, up.x, up.y)
+				if g.getTile(x, y) == room2 && s.getTile(x, y) == nothing && d > best {
+					down, best = vec2{x, y}, d
+				}
+			}
+		}
+	}
+	s.setTile(up.x, up.y, stairsUp)
+	if down != up {
+		s.setTile(down.x, down.y, stairsDown)
+	}
+
+	return m
+}
+
+// Call a function for each tile across the width of a tunneler
+func (t tunneler) forEachTile(f func(x, y int)) {
+	d := walkOffsets[t.dir]
+	// Perpendicular to the direction
+	px, py := -d.y, d.x
+	for i := -(t.width - 1) / 2; i <= t.width/2; i++ {
+		f(t.x+px*i, t.y+py*i)
+	}
+}
+
+// Whether a tunneler can dig its next step, without leaving the map or
+// digging into rooms
+func canTunnel(g, s *Layer, t tunneler) bool {
+	d := walkOffsets[t.dir]
+	t.x, t.y = t.x+d.x, t.y+d.y
+	ok := true
+	t.forEachTile(func(x, y int) {
+		if x < 1 || y < 1 || x >= g.Width-1 || y >= g.Height-1 ||
+			s.getTile(x, y) != nothing || g.getTile(x, y) == room {
+			ok = false
+		}
+	})
+	return ok
+}
+
+// Try to place a walled room in front of a tunneler, with an opening where
+// the tunnel meets it
+func addTunnelerRoom(rr *rand.Rand, g, s *Layer, t tunneler, minRoomSize, maxRoomSize int) (rect, bool) {
+	// Rooms need walls and at least one floor tile
+	minRoomSize = imax(minRoomSize, 3)
+	maxRoomSize = imax(maxRoomSize, minRoomSize)
+	w := rr.Intn(maxRoomSize-minRoomSize+1) + minRoomSize
+	h := rr.Intn(maxRoomSize-minRoomSize+1) + minRoomSize
+	d := walkOffsets[t.dir]
+	// The opening, on the room's wall
+	ox, oy := t.x+d.x, t.y+d.y
+	var r rect
+	switch t.dir {
+	case 0:
+		r = rect{ox - rr.Intn(w-2) - 1, oy - h + 1, w, h}
+	case 1:
+		r = rect{ox, oy - rr.Intn(h-2) - 1, w, h}
+	case 2:
+		r = rect{ox - rr.Intn(w-2) - 1, oy, w, h}
+	case 3:
+		r = rect{ox - w + 1, oy - rr.Intn(h-2) - 1, w, h}
+	}
+	if r.x < 0 || r.y < 0 || r.x+r.w > g.Width || r.y+r.h > g.Height ||
+		!g.isClear(r.x, r.y, r.w, r.h) || !s.isClear(r.x, r.y, r.w, r.h) {
+		return r, false
+	}
+	s.rectangle(r, wall2, false)
+	g.rectangle(rect{r.x + 1, r.y + 1, r.w - 2, r.h - 2}, room, true)
+	s.setTile(ox, oy, nothing)
+	g.setTile(ox, oy, room2)
+	return r, true
+}
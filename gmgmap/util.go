@@ -173,3 +173,51 @@ func manhattanDistance(x1, y1, x2, y2 int) int {
 func euclideanDistance(x1, y1, x2, y2 int) float64 {
 	return math.Sqrt(math.Pow(float64(x1-x2), 2) + math.Pow(float64(y1-y2), 2))
 }
+
+// Union-find over n elements
+type disjointSet []int
+
+func newDisjointSet(n int) disjointSet {
+	d := make(disjointSet, n)
+	for i := range d {
+		d[i] = i
+	}
+	return d
+}
+
+func (d disjointSet) find(i int) int {
+	for d[i] != i {
+		d[i] = d[d[i]]
+		i = d[i]
+	}
+	return i
+}
+
+// Merge the sets containing i and j; returns false if already in the same set
+func (d disjointSet) union(i, j int) bool {
+	ri, rj := d.find(i), d.find(j)
+	if ri == rj {
+		return false
+	}
+	d[ri] = rj
+	return true
+}
+
+// Min-heap of tiles by priority, for use with container/heap
+type tilePriority struct {
+	priority float64
+	x, y     int
+}
+
+type tileHeap []tilePriority
+
+func (h tileHeap) Len() int            { return len(h) }
+func (h tileHeap) Less(i, j int) bool  { return h[i].priority < h[j].priority }
+func (h tileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tileHeap) Push(x interface{}) { *h = append(*h, x.(tilePriority)) }
+func (h *tileHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
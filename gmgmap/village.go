@@ -9,17 +9,64 @@ import (
 )
 
 type building struct {
-	r          rect
-	importance int
+	r            rect
+	importance   int
+	buildingType int
+	fp           footprint
+	doors        []buildingDoor
+	facing       int
 }
 
-func (b building) addNPC(rr *rand.Rand, c *Layer) {
-	// Try to place a random NPC somewhere inside the building
-	c.setTileInAreaIfEmpty(rr, rect{b.r.x + 1, b.r.y + 1, b.r.w - 2, b.r.h - 2}, player)
+func (b building) addNPC(rr *rand.Rand, s, f, c *Layer, tile rune) {
+	// Try to place a random NPC somewhere inside the building, clear of
+	// interior walls and furniture
+	r := rect{b.r.x + 1, b.r.y + 1, b.r.w - 2, b.r.h - 2}
+	for i := 0; i < 100; i++ {
+		x := rr.Intn(r.w) + r.x
+		y := rr.Intn(r.h) + r.y
+		if b.fp.isIn(x, y) && c.getTile(x, y) == nothing && s.getTile(x, y) == nothing &&
+			!isBlocking(f.getTile(x, y)) {
+			c.setTile(x, y, tile)
+			break
+		}
+	}
 }
 
-// NewVillage - create a village, made up of multiple buildings
+// Floor and wall tiles, based on importance
+func (b building) tiles() (rune, rune) {
+	if b.importance > 10 {
+		return room2, wall2
+	}
+	return room, wall
+}
+
+// NewVillage - create a village, made up of multiple buildings.
+// Buildings are given types by importance and the size of the village, from
+// houses to shops, taverns, smithies, temples and a town hall; each type has
+// its own sign, decorations outside and NPCs, recorded as map objects.
+// Bigger buildings can have L, T, U, courtyard or cross-shaped footprints,
+// depending on their type.
+// Buildings face the centre of the village, with their main entrance on that
+// side, and large buildings have a second entrance; paths lead to the doors.
+// Free land outdoors has a market square or well, fenced yards, crop fields,
+// a graveyard by the temple and flower gardens.
 func NewVillage(rr *rand.Rand, exportFunc func(*Map), width, height, buildingPadding int) *Map {
+	return NewVillageWithOptions(rr, exportFunc, width, height, buildingPadding, VillageOptions{})
+}
+
+// VillageOptions - optional features of villages
+type VillageOptions struct {
+	// Buildings are bigger, and are furnished inside: important buildings as
+	// shops, and other buildings partitioned into rooms
+	Interiors bool
+	// Enclosed by a palisade, or a stone wall for towns, with towers at the
+	// corners and roads leaving through gatehouses
+	Walled bool
+}
+
+// NewVillageWithOptions - create a village like NewVillage, with optional
+// interiors and walls
+func NewVillageWithOptions(rr *rand.Rand, exportFunc func(*Map), width, height, buildingPadding int, opts VillageOptions) *Map {
 	m := NewMap(width, height)
 	g := m.Layer("Ground")
 	s := m.Layer("Structures")
@@ -29,31 +76,62 @@ func NewVillage(rr *rand.Rand, exportFunc func(*Map), width, height, buildingPad
 	g.fill(grass)
 	exportFunc(m)
 
-	buildings := genBuildings(rr, width, height, buildingPadding)
+	addVillage(rr, m, exportFunc, g, s, f, rect{0, 0, width, height}, buildingPadding, opts.Interiors, opts.Walled)
+
+	return m
+}
+
+// Add a village within an area of grass, returning the buildings and, if
+// walled, where the roads leaving the gates meet the edge of the area
+func addVillage(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s, f *Layer, r rect, buildingPadding int, interiors, walled bool) ([]building, []vec2) {
+	minSize, maxSize := 5, 7
+	if interiors {
+		minSize, maxSize = 7, 10
+	}
+	market := marketSquare(r)
+	inner := r
+	if walled {
+		inner = townInterior(r)
+	}
+	buildings := genBuildings(rr, inner, buildingPadding, minSize, maxSize, market)
 	assignBuildingImportance(rr, buildings)
+	assignBuildingTypes(buildings)
+	assignBuildingShapes(rr, buildings)
+	buildings = assignEntrances(buildings, r)
 	placeBuildings(m, exportFunc, g, s, f, buildings)
 	exportFunc(m)
-	addPaths(rr, m, exportFunc, g, s, buildings)
+	if interiors {
+		addInteriors(rr, m, exportFunc, buildings)
+	}
+	var gates []buildingDoor
+	if walled && len(buildings) >= 2 {
+		gates = addTownWall(rr, m, exportFunc, s, r, buildings, market)
+	}
+	world, exits := addPaths(rr, m, exportFunc, g, s, r, buildings, gates)
 	exportFunc(m)
+	addDecorations(rr, m, exportFunc, g, s, f, buildings)
+	addVillageFeatures(rr, m, exportFunc, g, s, f, world, r, market, buildings, buildingPadding)
 	c := m.Layer("Characters")
-	placeNPCs(rr, m, exportFunc, c, buildings)
-
-	return m
+	placeNPCs(rr, m, exportFunc, s, f, c, buildings)
+	addBuildingObjects(m, buildings)
+	return buildings, exits
 }
 
-func genBuildings(rr *rand.Rand, width, height, buildingPadding int) []building {
+// Place buildings at random, padded apart and clear of a reserved area
+func genBuildings(rr *rand.Rand, r rect, buildingPadding, minSize, maxSize int, reserved rect) []building {
 	buildings := make([]building, 0)
 	// Keep placing buildings for a while
 	for i := 0; i < 500; i++ {
-		w := rr.Intn(3) + 5
-		h := rr.Intn(3) + 5
-		x := rr.Intn(width - w)
-		y := rr.Intn(height - h)
-		if x < 0 || y < 0 {
+		w := rr.Intn(maxSize-minSize+1) + minSize
+		h := rr.Intn(maxSize-minSize+1) + minSize
+		if r.w <= w || r.h <= h {
 			continue
 		}
+		x := rr.Intn(r.w-w) + r.x
+		y := rr.Intn(r.h-h) + r.y
 		// Check if it overlaps with any existing buildings
-		overlaps := false
+		overlaps := reserved.w > 0 && reserved.Overlaps(
+			rect{x - buildingPadding, y - buildingPadding, w + buildingPadding*2, h + buildingPadding*2})
 		for _, b := range buildings {
 			// Add a bit of padding between the buildings
 			if b.r.Overlaps(
@@ -69,7 +147,9 @@ func genBuildings(rr *rand.Rand, width, height, buildingPadding int) []building
 		if overlaps {
 			continue
 		}
-		buildings = append(buildings, building{rect{x, y, w, h}, 0})
+		r := rect{x, y, w, h}
+		buildings = append(buildings,
+			building{r, 0, buildingHouse, newFootprint(FootprintRect, r), nil, DirectionDown})
 	}
 	return buildings
 }
@@ -83,28 +163,31 @@ func assignBuildingImportance(rr *rand.Rand, buildings []building) {
 
 func placeBuildings(m *Map, exportFunc func(*Map), g, s, f *Layer, buildings []building) {
 	for _, building := range buildings {
-		imp := building.importance
 		// Use tiles based on importance
-		tileRoom, tileWall := room, wall
-		if imp > 10 {
-			tileRoom, tileWall = room2, wall2
-		}
-		hasSign := imp > 5
-		addBuilding(g, s, f, building.r, tileRoom, tileWall, hasSign)
+		tileRoom, tileWall := building.tiles()
+		hasSign := buildingTypes[building.buildingType].sign != ""
+		addBuilding(g, s, f, building.fp, building.doors, tileRoom, tileWall, hasSign)
 		exportFunc(m)
 	}
 }
 
-func addPaths(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s *Layer, buildings []building) {
+// Draw paths between buildings, and main roads from each gate to the edge of
+// the village and to the most important building.
+// Returns how much each tile is used, and where the main roads leave.
+func addPaths(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s *Layer, r rect, buildings []building, gates []buildingDoor) (villageWorld, []vec2) {
 	// Draw paths between random pairs of entrances via importance
 	// Ensure at least one path exists for all buildings
+	world := newVillageWorld(r, s)
+	if len(buildings) < 2 {
+		return world, nil
+	}
+	exits := addMainRoads(world, r, buildings, gates)
 
 	impSum := 0
 	for _, building := range buildings {
 		impSum += building.importance
 	}
 
-	world := newVillageWorld(g.Width, g.Height, s)
 	buildingsWithPaths := map[int]bool{}
 	numPaths := len(buildings) * 3
 	for i := 0; i < numPaths || len(buildingsWithPaths) < len(buildings); i++ {
@@ -127,36 +210,74 @@ func addPaths(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s *Layer, buildin
 			}
 			buildingsWithPaths[building1] = true
 			buildingsWithPaths[building2] = true
-			// TODO: find entrance and start/end paths there
+			// Start and end just outside the doors closest to each other
 			b1 := buildings[building1]
 			b2 := buildings[building2]
-			startX := b1.r.x + b1.r.w/2
-			startY := b1.r.y + b1.r.h
-			endX := b2.r.x + b2.r.w/2
-			endY := b2.r.y + b2.r.h
-			path, _, found := world.addPath(startX, startY, endX, endY)
+			start := b1.doorTowards(b2).outside()
+			end := b2.doorTowards(b1).outside()
+			path, _, found := world.addPath(start.x, start.y, end.x, end.y)
 			if !found {
 				fmt.Println("Could not find path")
 			} else {
 				for _, t := range path {
 					world.incUsage(t.(*villageTile).x, t.(*villageTile).y)
 				}
-				placePaths(g, s, world, tree, grass, road, road2)
+				placePaths(g, s, world, r, tree, grass, road, road2)
 				exportFunc(m)
-				unplacePaths(s, tree)
+				unplacePaths(s, r, tree)
 			}
 			break
 		}
 	}
-	placePaths(g, s, world, tree, grass, road, road2)
+	placePaths(g, s, world, r, tree, grass, road, road2)
+	return world, exits
+}
+
+// Main roads run from the edge of the village, through each gate and on to
+// the nearest door of the most important building; they're used enough to
+// be roads from the start
+func addMainRoads(world villageWorld, r rect, buildings []building, gates []buildingDoor) []vec2 {
+	const usage = 4
+	centre := buildings[0]
+	for _, b := range buildings {
+		if b.importance > centre.importance {
+			centre = b
+		}
+	}
+	var exits []vec2
+	for _, gate := range gates {
+		o := walkOffsets[gate.facing-DirectionUp]
+		exit := gate.outside()
+		for r.isIn(exit.x+o.x, exit.y+o.y) {
+			exit = vec2{exit.x + o.x, exit.y + o.y}
+		}
+		end := centre.doors[0].outside()
+		for _, d := range centre.doors {
+			if p := d.outside(); manhattanDistance(p.x, p.y, gate.x, gate.y) <
+				manhattanDistance(end.x, end.y, gate.x, gate.y) {
+				end = p
+			}
+		}
+		path, _, found := world.addPath(exit.x, exit.y, end.x, end.y)
+		if !found {
+			continue
+		}
+		for _, t := range path {
+			for i := 0; i < usage; i++ {
+				world.incUsage(t.(*villageTile).x, t.(*villageTile).y)
+			}
+		}
+		exits = append(exits, exit)
+	}
+	return exits
 }
 
-func unplacePaths(s *Layer, usage0 rune) {
+func unplacePaths(s *Layer, r rect, usage0 rune) {
 	// To avoid not being able to find paths, because we are
 	// iteratively placing trees for usage0 which blocks paths,
 	// we clear all tree tiles
-	for y := 0; y < s.Height; y++ {
-		for x := 0; x < s.Width; x++ {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
 			if s.getTile(x, y) == usage0 {
 				s.setTile(x, y, nothing)
 			}
@@ -164,10 +285,10 @@ func unplacePaths(s *Layer, usage0 rune) {
 	}
 }
 
-func placePaths(g, s *Layer, world villageWorld, usage0, usage1, usage2, usage3 rune) {
+func placePaths(g, s *Layer, world villageWorld, r rect, usage0, usage1, usage2, usage3 rune) {
 	// Draw paths based on how well they're used
-	for y := 0; y < g.Height; y++ {
-		for x := 0; x < g.Width; x++ {
+	for y := r.y; y < r.y+r.h; y++ {
+		for x := r.x; x < r.x+r.w; x++ {
 			usage := world.getUsage(x, y)
 			if usage == 0 {
 				if g.getTile(x, y) == grass && s.getTile(x, y) == nothing {
@@ -184,28 +305,36 @@ func placePaths(g, s *Layer, world villageWorld, usage0, usage1, usage2, usage3
 	}
 }
 
-func placeNPCs(rr *rand.Rand, m *Map, exportFunc func(*Map), c *Layer, buildings []building) {
-	// Place NPCs based on importance
+func placeNPCs(rr *rand.Rand, m *Map, exportFunc func(*Map), s, f, c *Layer, buildings []building) {
+	// Place NPCs based on importance, starting with the owner unless the
+	// interior already has one
 	for _, building := range buildings {
-		for i := 0; i < building.importance/2; i++ {
-			building.addNPC(rr, c)
+		owner := buildingTypes[building.buildingType].owner
+		numNPCs := building.importance / 2
+		if building.buildingType != buildingHouse && !c.hasTileIn(building.r, owner) {
+			building.addNPC(rr, s, f, c, owner)
+			numNPCs--
+		}
+		for i := 0; i < numNPCs; i++ {
+			building.addNPC(rr, s, f, c, player)
 		}
 		exportFunc(m)
 	}
 }
 
-func addBuilding(g, s, f *Layer, r rect, tileRoom, tileWall rune, hasSign bool) {
-	// Perimeter
-	s.rectangle(r, tileWall, false)
-	// Floor
-	g.rectangle(rect{r.x + 1, r.y + 1, r.w - 2, r.h - 2}, tileRoom, true)
-	// Entrance
-	entranceX := r.x + r.w/2
-	entranceY := r.y + r.h - 1
-	g.setTile(entranceX, entranceY, tileRoom)
-	s.setTile(entranceX, entranceY, door)
-	if hasSign {
-		f.setTile(entranceX-1, entranceY, sign)
+func addBuilding(g, s, f *Layer, fp footprint, doors []buildingDoor, tileRoom, tileWall rune, hasSign bool) {
+	// Perimeter and floor
+	fp.draw(g, s, tileRoom, tileWall)
+	// Entrances
+	for _, d := range doors {
+		g.setTile(d.x, d.y, tileRoom)
+		s.setTile(d.x, d.y, door)
+	}
+	// Sign beside the main entrance
+	e := doors[0]
+	o := walkOffsets[(e.facing-DirectionUp+1)%4]
+	if hasSign && IsWall(s.getTile(e.x+o.x, e.y+o.y)) {
+		f.setTile(e.x+o.x, e.y+o.y, sign)
 	}
 }
 
@@ -225,8 +354,9 @@ func (t *villageTile) PathNeighbors() []astar.Pather {
 		{0, -1},
 		{0, 1},
 	} {
-		if n := t.s.getTile(t.x+offset[0], t.y+offset[1]); n == nothing {
-			neighbors = append(neighbors, t.w.tile(t.x+offset[0], t.y+offset[1]))
+		n := t.w.tile(t.x+offset[0], t.y+offset[1])
+		if n != nil && t.s.getTile(n.x, n.y) == nothing {
+			neighbors = append(neighbors, n)
 		}
 	}
 	return neighbors
@@ -245,10 +375,10 @@ func (t *villageTile) PathEstimatedCost(to astar.Pather) float64 {
 
 type villageWorld map[int]map[int]*villageTile
 
-func newVillageWorld(w, h int, s *Layer) villageWorld {
+func newVillageWorld(r rect, s *Layer) villageWorld {
 	world := villageWorld{}
-	for x := 0; x < w; x++ {
-		for y := 0; y < h; y++ {
+	for x := r.x; x < r.x+r.w; x++ {
+		for y := r.y; y < r.y+r.h; y++ {
 			world.setTile(&villageTile{x, y, s, world, 0}, x, y)
 		}
 	}
@@ -0,0 +1,177 @@
+package gmgmap
+
+import "sort"
+
+// A door in the outer wall of a building, and the direction it faces
+type buildingDoor struct {
+	vec2
+	facing int
+}
+
+// The tile just outside the door
+func (d buildingDoor) outside() vec2 {
+	o := walkOffsets[d.facing-DirectionUp]
+	return vec2{d.x + o.x, d.y + o.y}
+}
+
+// The tile just inside the door
+func (d buildingDoor) inside() vec2 {
+	o := walkOffsets[d.facing-DirectionUp]
+	return vec2{d.x - o.x, d.y - o.y}
+}
+
+// The main entrance
+func (b building) entrance() vec2 {
+	return b.doors[0].vec2
+}
+
+// The door closest to another building
+func (b building) doorTowards(other building) buildingDoor {
+	cx, cy := other.r.x+other.r.w/2, other.r.y+other.r.h/2
+	best := b.doors[0]
+	for _, d := range b.doors[1:] {
+		o, ob := d.outside(), best.outside()
+		if Abs(o.x-cx)+Abs(o.y-cy) < Abs(ob.x-cx)+Abs(ob.y-cy) {
+			best = d
+		}
+	}
+	return best
+}
+
+// Size of the inside of the building in its own frame, which faces the main
+// entrance: the width along the front wall, and the depth to the back wall
+func (b building) frameSize() (int, int) {
+	if b.facing == DirectionLeft || b.facing == DirectionRight {
+		return b.r.h - 2, b.r.w - 2
+	}
+	return b.r.w - 2, b.r.h - 2
+}
+
+// Position of a tile in the building's own frame: u along the front wall,
+// and v from the back wall (-1) to the front wall (the depth)
+func (b building) local(u, v int) (int, int) {
+	in := rect{b.r.x + 1, b.r.y + 1, b.r.w - 2, b.r.h - 2}
+	switch b.facing {
+	case DirectionUp:
+		return in.x + in.w - 1 - u, in.y + in.h - 1 - v
+	case DirectionLeft:
+		return in.x + in.w - 1 - v, in.y + u
+	case DirectionRight:
+		return in.x + v, in.y + in.h - 1 - u
+	}
+	return in.x + u, in.y + v
+}
+
+// Position of a tile in the building's own frame, from the map position
+func (b building) toLocal(x, y int) (int, int) {
+	in := rect{b.r.x + 1, b.r.y + 1, b.r.w - 2, b.r.h - 2}
+	switch b.facing {
+	case DirectionUp:
+		return in.x + in.w - 1 - x, in.y + in.h - 1 - y
+	case DirectionLeft:
+		return y - in.y, in.x + in.w - 1 - x
+	case DirectionRight:
+		return in.y + in.h - 1 - y, x - in.x
+	}
+	return x - in.x, y - in.y
+}
+
+// Find a place for a door in the outer wall facing a direction, as close to
+// the middle as possible, and set back into any notch in the footprint
+func (b building) findDoor(facing int) (buildingDoor, bool) {
+	b.facing = facing
+	w, depth := b.frameSize()
+	for i := 0; i < w; i++ {
+		// Alternate either side of the middle
+		u := w/2 + (i+1)/2*(1-i%2*2)
+		if u < 0 || u >= w {
+			continue
+		}
+		for v := depth; v >= 0; v-- {
+			x, y := b.local(u, v)
+			if !b.fp.isIn(x, y) {
+				continue
+			}
+			ix, iy := b.local(u, v-1)
+			lx, ly := b.local(u-1, v)
+			rx, ry := b.local(u+1, v)
+			if b.fp.isOutline(x, y) && b.fp.isIn(ix, iy) && !b.fp.isOutline(ix, iy) &&
+				b.fp.isOutline(lx, ly) && b.fp.isOutline(rx, ry) {
+				return buildingDoor{vec2{x, y}, facing}, true
+			}
+			break
+		}
+	}
+	return buildingDoor{}, false
+}
+
+// Give each building its main entrance on the side facing the centre of the
+// village, and large buildings a second entrance on another side.
+// Doors must open onto free ground within the village, so that paths can
+// reach them.
+// Buildings that have nowhere for a door are removed.
+func assignEntrances(buildings []building, r rect) []building {
+	cx, cy := r.x+r.w/2, r.y+r.h/2
+	var entered []building
+	for i := range buildings {
+		b := &buildings[i]
+		dx, dy := cx-(b.r.x+b.r.w/2), cy-(b.r.y+b.r.h/2)
+		// Prefer facing down when there's a tie
+		facings := []int{DirectionDown, DirectionRight, DirectionLeft, DirectionUp}
+		sort.SliceStable(facings, func(i, j int) bool {
+			oi, oj := walkOffsets[facings[i]-DirectionUp], walkOffsets[facings[j]-DirectionUp]
+			return oi.x*dx+oi.y*dy > oj.x*dx+oj.y*dy
+		})
+		if setDoors(buildings, i, r, facings) {
+			entered = append(entered, *b)
+		}
+	}
+	return entered
+}
+
+// Give a building its main entrance, and a second entrance if it's large,
+// trying the sides in order of preference.
+// If no door is clear, fall back to any side with room for a door.
+// Returns false if the building has nowhere for a door.
+func setDoors(buildings []building, i int, r rect, facings []int) bool {
+	b := &buildings[i]
+	numDoors := 1
+	if b.r.w*b.r.h >= 49 {
+		numDoors = 2
+	}
+	b.doors = nil
+	for _, facing := range facings {
+		d, ok := b.findDoor(facing)
+		if ok && isDoorClear(buildings, i, r, d.outside()) {
+			b.doors = append(b.doors, d)
+			if len(b.doors) == numDoors {
+				break
+			}
+		}
+	}
+	for _, facing := range facings {
+		if len(b.doors) > 0 {
+			break
+		}
+		if d, ok := b.findDoor(facing); ok {
+			b.doors = append(b.doors, d)
+		}
+	}
+	if len(b.doors) == 0 {
+		return false
+	}
+	b.facing = b.doors[0].facing
+	return true
+}
+
+func isDoorClear(buildings []building, i int, r rect, p vec2) bool {
+	if !r.isIn(p.x, p.y) {
+		return false
+	}
+	for j, b := range buildings {
+		if j != i && b.r.isIn(p.x, p.y) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,291 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"strconv"
+)
+
+// Outdoor features of a village
+const (
+	featureMarket = iota
+	featureWell
+	featureYard
+	featureField
+	featureGraveyard
+	featureGarden
+)
+
+var featureNames = []string{
+	featureMarket:    "Market square",
+	featureWell:      "Well",
+	featureYard:      "Yard",
+	featureField:     "Field",
+	featureGraveyard: "Graveyard",
+	featureGarden:    "Garden",
+}
+
+type villageFeature struct {
+	r    rect
+	kind int
+}
+
+// Free land for outdoor features: grass or trees that no path uses, clear of
+// doors, the padding around buildings, and other features
+type featureSites struct {
+	g, s, f   *Layer
+	world     villageWorld
+	r         rect
+	buildings []building
+	padding   int
+	doors     map[vec2]bool
+	features  []villageFeature
+}
+
+func (fs featureSites) isFree(x, y int) bool {
+	return fs.r.isIn(x, y) && fs.world.getUsage(x, y) == 0 && isYard(fs.g, fs.s, fs.f, x, y) &&
+		!fs.doors[vec2{x, y}]
+}
+
+// Whether a site is all free land, outside the padding of buildings other
+// than one (-1 for none), and a tile away from other features
+func (fs featureSites) isSiteFree(site rect, except int) bool {
+	for y := site.y; y < site.y+site.h; y++ {
+		for x := site.x; x < site.x+site.w; x++ {
+			if !fs.isFree(x, y) {
+				return false
+			}
+		}
+	}
+	for i, b := range fs.buildings {
+		p := fs.padding
+		if i != except && site.Overlaps(rect{b.r.x - p, b.r.y - p, b.r.w + p*2, b.r.h + p*2}) {
+			return false
+		}
+	}
+	for _, ft := range fs.features {
+		if site.Overlaps(rect{ft.r.x - 1, ft.r.y - 1, ft.r.w + 2, ft.r.h + 2}) {
+			return false
+		}
+	}
+	return true
+}
+
+// Try random free sites, and return the one closest to a target
+func (fs featureSites) find(rr *rand.Rand, w, h int, target vec2) (rect, bool) {
+	var best rect
+	found := false
+	bestDistance := 0
+	if fs.r.w < w || fs.r.h < h {
+		return best, false
+	}
+	for i := 0; i < 200; i++ {
+		site := rect{rr.Intn(fs.r.w-w+1) + fs.r.x, rr.Intn(fs.r.h-h+1) + fs.r.y, w, h}
+		if !fs.isSiteFree(site, -1) {
+			continue
+		}
+		d := manhattanDistance(site.x+w/2, site.y+h/2, target.x, target.y)
+		if !found || d < bestDistance {
+			best = site
+			bestDistance = d
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Clear trees from a site, ready for a feature
+func (fs *featureSites) add(site rect, kind int) {
+	for y := site.y; y < site.y+site.h; y++ {
+		for x := site.x; x < site.x+site.w; x++ {
+			if fs.s.getTile(x, y) == tree {
+				fs.s.setTile(x, y, nothing)
+			}
+		}
+	}
+	fs.features = append(fs.features, villageFeature{site, kind})
+}
+
+// Area in the middle of a village kept free of buildings for a market square,
+// if the village is big enough for one
+func marketSquare(r rect) rect {
+	if r.w < 32 || r.h < 24 {
+		return rect{}
+	}
+	w, h := iclamp(r.w/4, 7, 11), iclamp(r.h/4, 5, 9)
+	return rect{r.x + (r.w-w)/2, r.y + (r.h-h)/2, w, h}
+}
+
+// Add outdoor features on the free land of a village, keeping clear of paths
+// and the padding around buildings: a paved market square with stalls and a
+// fountain, or a well, fenced yards behind houses, crop fields towards the
+// edge of the village, a fenced graveyard by the temple, and flower gardens.
+// Each feature is recorded as a map object.
+func addVillageFeatures(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s, f *Layer, world villageWorld, r, market rect, buildings []building, buildingPadding int) {
+	fs := featureSites{g, s, f, world, r, buildings, buildingPadding, map[vec2]bool{}, nil}
+	for _, b := range buildings {
+		for _, d := range b.doors {
+			fs.doors[d.outside()] = true
+		}
+	}
+	centre := vec2{r.x + r.w/2, r.y + r.h/2}
+
+	if market.w > 0 {
+		addMarket(rr, m, &fs, market)
+	} else if site, ok := fs.find(rr, 1, 1, centre); ok {
+		fs.add(site, featureWell)
+		s.setTile(site.x, site.y, well)
+	}
+	exportFunc(m)
+
+	for i, b := range buildings {
+		if b.buildingType == buildingHouse && rr.Intn(2) == 0 {
+			addYard(rr, &fs, i)
+		}
+	}
+	exportFunc(m)
+
+	for i := 0; i < len(buildings)/4+1; i++ {
+		// Fields towards a random corner of the village
+		w, h := rr.Intn(3)+4, rr.Intn(2)+3
+		corner := vec2{r.x + rr.Intn(2)*(r.w-1), r.y + rr.Intn(2)*(r.h-1)}
+		if site, ok := fs.find(rr, w, h, corner); ok {
+			fs.add(site, featureField)
+			f.rectangle(site, crop, true)
+		}
+	}
+	exportFunc(m)
+
+	for _, b := range buildings {
+		if b.buildingType == buildingTemple {
+			addGraveyard(rr, &fs, vec2{b.r.x + b.r.w/2, b.r.y + b.r.h/2})
+		}
+	}
+	exportFunc(m)
+
+	for i := 0; i < len(buildings)/4 && len(buildings) > 0; i++ {
+		// Gardens by a random building
+		b := buildings[rr.Intn(len(buildings))]
+		w, h := rr.Intn(2)+2, 2
+		if rr.Intn(2) == 0 {
+			w, h = h, w
+		}
+		if site, ok := fs.find(rr, w, h, vec2{b.r.x + b.r.w/2, b.r.y + b.r.h/2}); ok {
+			fs.add(site, featureGarden)
+			f.rectangle(site, flower, true)
+		}
+	}
+	exportFunc(m)
+
+	counts := map[int]int{}
+	for _, ft := range fs.features {
+		counts[ft.kind]++
+		m.AddObject(featureNames[ft.kind]+" "+strconv.Itoa(counts[ft.kind]), "feature",
+			ft.r.x, ft.r.y, ft.r.w, ft.r.h, map[string]string{"type": featureNames[ft.kind]})
+	}
+}
+
+// A market square: stalls of counters with stock and a merchant behind, set
+// around a fountain in the middle, all clear of paths, then paved over
+func addMarket(rr *rand.Rand, m *Map, fs *featureSites, market rect) {
+	v := m.Layer("Inventory")
+	c := m.Layer("Characters")
+	centre := vec2{market.x + market.w/2, market.y + market.h/2}
+	for d := 0; d < market.w/2; d++ {
+		if fs.isFree(centre.x+d, centre.y) {
+			fs.s.setTile(centre.x+d, centre.y, well)
+			fs.features = append(fs.features, villageFeature{rect{centre.x + d, centre.y, 1, 1}, featureWell})
+			break
+		}
+	}
+	for y := market.y + 1; y < market.y+market.h; y += 3 {
+		for x := market.x + 1; x+1 < market.x+market.w-1; x += 4 {
+			stall := rect{x, y - 1, 2, 2}
+			if rr.Intn(3) == 0 || !fs.isSiteFree(stall, -1) {
+				continue
+			}
+			for dx := 0; dx < 2; dx++ {
+				fs.f.setTile(x+dx, y, counter)
+				if rr.Intn(3) < 2 {
+					v.setTile(x+dx, y, stock)
+				}
+			}
+			c.setTile(x+rr.Intn(2), y-1, shopkeeper)
+		}
+	}
+	// Pave the square
+	for y := market.y; y < market.y+market.h; y++ {
+		for x := market.x; x < market.x+market.w; x++ {
+			if fs.s.getTile(x, y) == tree {
+				fs.s.setTile(x, y, nothing)
+			}
+			fs.g.setTile(x, y, road2)
+		}
+	}
+	fs.features = append(fs.features, villageFeature{market, featureMarket})
+}
+
+// A yard fenced off behind a house, with a gate at the far end, planted with
+// crops or flowers
+func addYard(rr *rand.Rand, fs *featureSites, i int) {
+	b := fs.buildings[i]
+	w, _ := b.frameSize()
+	const depth = 3
+	// The yard runs the width of the building, from the back wall out
+	x0, y0 := b.local(-1, -2)
+	x1, y1 := b.local(w, -1-depth)
+	yard := rect{imin(x0, x1), imin(y0, y1), Abs(x1-x0) + 1, Abs(y1-y0) + 1}
+	if !fs.isSiteFree(yard, i) {
+		return
+	}
+	fs.add(yard, featureYard)
+	plant := crop
+	if rr.Intn(2) == 0 {
+		plant = flower
+	}
+	for v := -2; v >= -1-depth; v-- {
+		for u := -1; u <= w; u++ {
+			x, y := b.local(u, v)
+			if u == -1 || u == w || v == -1-depth {
+				if u != w/2 {
+					fs.s.setTile(x, y, fence)
+				}
+			} else if rr.Intn(2) == 0 {
+				fs.f.setTile(x, y, plant)
+			}
+		}
+	}
+}
+
+// A graveyard fenced off near a target, with rows of graves and a gate on the
+// side facing the target
+func addGraveyard(rr *rand.Rand, fs *featureSites, target vec2) {
+	site, ok := fs.find(rr, 7, 5, target)
+	if !ok {
+		if site, ok = fs.find(rr, 5, 5, target); !ok {
+			return
+		}
+	}
+	fs.add(site, featureGraveyard)
+	fs.s.rectangle(site, fence, false)
+	// Gate in the middle of the side closest to the target
+	gate := vec2{site.x + site.w/2, site.y + site.h - 1}
+	inside := vec2{gate.x, gate.y - 1}
+	cx, cy := site.x+site.w/2, site.y+site.h/2
+	dx, dy := target.x-cx, target.y-cy
+	switch {
+	case Abs(dx) > Abs(dy) && dx > 0:
+		gate, inside = vec2{site.x + site.w - 1, cy}, vec2{site.x + site.w - 2, cy}
+	case Abs(dx) > Abs(dy):
+		gate, inside = vec2{site.x, cy}, vec2{site.x + 1, cy}
+	case dy < 0:
+		gate, inside = vec2{cx, site.y}, vec2{cx, site.y + 1}
+	}
+	fs.s.setTile(gate.x, gate.y, nothing)
+	for y := site.y + 1; y < site.y+site.h-1; y += 2 {
+		for x := site.x + 1; x < site.x+site.w-1; x += 2 {
+			if (vec2{x, y}) != inside {
+				fs.f.setTile(x, y, grave)
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package gmgmap
+
+import "math/rand"
+
+// Whether furniture blocks movement
+func isBlocking(tile rune) bool {
+	switch tile {
+	case counter, shelf, table, pot:
+		return true
+	}
+	return false
+}
+
+// Fill village buildings with interiors, chosen by type: shops and smithies
+// with counters and shelves, taverns with a bar and tables, temples with an
+// aisle, and rooms for the rest
+func addInteriors(rr *rand.Rand, m *Map, exportFunc func(*Map), buildings []building) {
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	f := m.Layer("Furniture")
+	v := m.Layer("Inventory")
+	c := m.Layer("Characters")
+	for _, b := range buildings {
+		switch b.buildingType {
+		case buildingShop, buildingSmithy:
+			addShopInterior(rr, s, f, v, c, b)
+		case buildingTavern:
+			addTavernInterior(rr, s, f, c, b)
+		case buildingTemple:
+			addTempleInterior(rr, s, f, c, b)
+		default:
+			addHouseInterior(rr, g, s, f, b)
+		}
+		addWindows(s, f, b)
+		exportFunc(m)
+	}
+}
+
+// A shop: a counter across the back with a shopkeeper behind it, shelves of
+// stock along the sides, and hangings on the back wall.
+// Shops, taverns and temples are laid out in the building's own frame, so
+// the back is opposite the main entrance.
+func addShopInterior(rr *rand.Rand, s, f, v, c *Layer, b building) {
+	w, depth := b.frameSize()
+	// Leave a gap at one end to get behind the counter
+	counterU := rr.Intn(2)
+	for u := counterU; u < counterU+w-1; u++ {
+		x, y := b.local(u, 1)
+		furnish(s, f, b, x, y, counter)
+	}
+	x, y := b.local(counterU+(w-1)/2, 0)
+	placeOwner(s, c, b, x, y)
+	for d := 3; d < depth-1; d++ {
+		for _, u := range []int{0, w - 1} {
+			x, y := b.local(u, d)
+			if furnish(s, f, b, x, y, shelf) && rr.Intn(3) < 2 {
+				v.setTile(x, y, stock)
+			}
+		}
+	}
+	addBackHangings(rr, s, f, b, -1)
+}
+
+// Hangings along the back wall, skipping one position
+func addBackHangings(rr *rand.Rand, s, f *Layer, b building, skipU int) {
+	w, _ := b.frameSize()
+	for u := 0; u < w; u++ {
+		x, y := b.local(u, -1)
+		if u != skipU && rr.Intn(2) == 0 && IsWall(s.getTile(x, y)) {
+			f.setTile(x, y, hanging)
+		}
+	}
+}
+
+// A tavern: a bar across the back with the barkeep behind it, and tables with
+// chairs spread through the rest
+func addTavernInterior(rr *rand.Rand, s, f, c *Layer, b building) {
+	w, depth := b.frameSize()
+	barU := rr.Intn(2)
+	for u := barU; u < barU+w-1; u++ {
+		x, y := b.local(u, 1)
+		furnish(s, f, b, x, y, counter)
+	}
+	x, y := b.local(barU+(w-1)/2, 0)
+	placeOwner(s, c, b, x, y)
+	for d := 3; d < depth-1; d += 2 {
+		for u := 1 + rr.Intn(2); u < w-1; u += 3 {
+			x, y := b.local(u, d)
+			if furnish(s, f, b, x, y, table) {
+				for _, cu := range []int{u - 1, u + 1} {
+					cx, cy := b.local(cu, d)
+					furnish(s, f, b, cx, cy, chair)
+				}
+			}
+		}
+	}
+}
+
+// A temple: an aisle of rug from the entrance to the altar at the back, with
+// pots along the sides
+func addTempleInterior(rr *rand.Rand, s, f, c *Layer, b building) {
+	w, depth := b.frameSize()
+	e := b.entrance()
+	eu, _ := b.toLocal(e.x, e.y)
+	x, y := b.local(eu, 1)
+	furnish(s, f, b, x, y, table)
+	for d := 2; d < depth; d++ {
+		x, y := b.local(eu, d)
+		furnish(s, f, b, x, y, rug)
+	}
+	x, y = b.local(eu, 0)
+	placeOwner(s, c, b, x, y)
+	for d := 2; d < depth-1; d += 2 {
+		for _, u := range []int{0, w - 1} {
+			if rr.Intn(3) < 2 {
+				x, y := b.local(u, d)
+				furnish(s, f, b, x, y, pot)
+			}
+		}
+	}
+	addBackHangings(rr, s, f, b, eu)
+}
+
+// Place the owner behind the counter or altar, if it's on the floor;
+// otherwise they're placed with the other NPCs
+func placeOwner(s, c *Layer, b building, x, y int) {
+	if b.fp.isIn(x, y) && s.getTile(x, y) == nothing {
+		c.setTile(x, y, buildingTypes[b.buildingType].owner)
+	}
+}
+
+// A house: partitioned into rooms like NewInterior, with the room by the
+// entrance as the lobby, then furnished
+func addHouseInterior(rr *rand.Rand, g, s, f *Layer, b building) {
+	tileRoom, tileWall := b.tiles()
+	// Try partitioning until no entrance is blocked by a wall
+	var rooms []bspRoom
+	for i := 0; i < 10 && rooms == nil; i++ {
+		rooms = b.fp.splitRooms(rr, 3, 5)
+		for _, r := range rooms {
+			for _, d := range b.doors {
+				if in := d.inside(); isOnPerimeter(r.r, in.x, in.y) {
+					rooms = nil
+					break
+				}
+			}
+			if rooms == nil {
+				break
+			}
+		}
+	}
+	if len(rooms) < 2 {
+		addRoomFurniture(rr, s, f, b, rect{b.r.x + 1, b.r.y + 1, b.r.w - 2, b.r.h - 2}, true)
+		return
+	}
+	b.fp.drawRooms(g, s, rooms, tileRoom, tileWall)
+	lobby := rooms[0]
+	in := b.doors[0].inside()
+	for _, r := range rooms {
+		if r.r.isIn(in.x, in.y) {
+			lobby = r
+		}
+	}
+	for _, d := range b.doors {
+		s.setTile(d.x, d.y, door)
+	}
+	connectInteriorRooms(g, s, rooms, lobby, tileRoom)
+	for _, r := range rooms {
+		addRoomFurniture(rr, s, f, b, rect{r.r.x + 1, r.r.y + 1, r.r.w - 2, r.r.h - 2},
+			r.r == lobby.r)
+	}
+}
+
+// Furnish a room: a table and chairs in the lobby, otherwise a rug, plus pots
+// in the corners and hangings on the wall
+func addRoomFurniture(rr *rand.Rand, s, f *Layer, b building, r rect, isLobby bool) {
+	if isLobby {
+		x, y := r.x+r.w/2, r.y+r.h/2
+		if furnish(s, f, b, x, y, table) {
+			furnish(s, f, b, x-1, y, chair)
+			furnish(s, f, b, x+1, y, chair)
+		}
+	} else if r.w >= 2 && r.h >= 2 {
+		for y := r.y + r.h/2; y < r.y+r.h/2+2 && y < r.y+r.h; y++ {
+			for x := r.x; x < r.x+r.w; x++ {
+				furnish(s, f, b, x, y, rug)
+			}
+		}
+	}
+	for _, corner := range []vec2{{r.x, r.y}, {r.x + r.w - 1, r.y},
+		{r.x, r.y + r.h - 1}, {r.x + r.w - 1, r.y + r.h - 1}} {
+		if rr.Intn(2) == 0 {
+			furnish(s, f, b, corner.x, corner.y, pot)
+		}
+	}
+	if r.w > 2 && rr.Intn(3) == 0 && s.getTile(r.x+r.w/2, r.y-1) != door {
+		f.setTile(r.x+r.w/2, r.y-1, hanging)
+	}
+}
+
+// Windows along the front wall, clear of doors and signs
+func addWindows(s, f *Layer, b building) {
+	w, depth := b.frameSize()
+	for u := 1; u < w-1; u += 2 {
+		x, y := b.local(u, depth)
+		lx, ly := b.local(u-1, depth)
+		rx, ry := b.local(u+1, depth)
+		ix, iy := b.local(u, depth-1)
+		if f.getTile(lx, ly) == nothing && f.getTile(x, y) == nothing &&
+			f.getTile(rx, ry) == nothing && IsWall(s.getTile(x, y)) &&
+			!IsDoor(s.getTile(lx, ly)) && !IsDoor(s.getTile(rx, ry)) &&
+			s.getTile(ix, iy) == nothing {
+			f.setTile(x, y, window)
+		}
+	}
+}
+
+func isOnPerimeter(r rect, x, y int) bool {
+	return r.isIn(x, y) && (x == r.x || y == r.y || x == r.x+r.w-1 || y == r.y+r.h-1)
+}
+
+// Place furniture on an empty floor tile inside a building, as long as every
+// other floor tile can still be reached from the entrance
+func furnish(s, f *Layer, b building, x, y int, tile rune) bool {
+	if !b.fp.isIn(x, y) || s.getTile(x, y) != nothing || f.getTile(x, y) != nothing {
+		return false
+	}
+	f.setTile(x, y, tile)
+	if isBlocking(tile) && !isBuildingWalkable(s, f, b) {
+		f.setTile(x, y, nothing)
+		return false
+	}
+	return true
+}
+
+func isBuildingWalkable(s, f *Layer, b building) bool {
+	isWalkable := func(x, y int) bool {
+		t := s.getTile(x, y)
+		return b.fp.isIn(x, y) && (t == nothing || IsDoor(t)) && !isBlocking(f.getTile(x, y))
+	}
+	total := 0
+	for y := b.r.y; y < b.r.y+b.r.h; y++ {
+		for x := b.r.x; x < b.r.x+b.r.w; x++ {
+			if isWalkable(x, y) {
+				total++
+			}
+		}
+	}
+	e := b.entrance()
+	seen := map[vec2]bool{e: true}
+	frontier := []vec2{e}
+	for len(frontier) > 0 {
+		t := frontier[len(frontier)-1]
+		frontier = frontier[:len(frontier)-1]
+		for _, d := range walkOffsets {
+			n := vec2{t.x + d.x, t.y + d.y}
+			if !seen[n] && isWalkable(n.x, n.y) {
+				seen[n] = true
+				frontier = append(frontier, n)
+			}
+		}
+	}
+	return len(seen) == total
+}
@@ -0,0 +1,162 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Functional types of village buildings
+const (
+	buildingHouse = iota
+	buildingShop
+	buildingTavern
+	buildingSmithy
+	buildingTemple
+	buildingTownHall
+)
+
+type buildingType struct {
+	name string
+	// Minimum importance for a building to be this type
+	minImportance int
+	// Minimum number of buildings in the village to have one, and how many
+	// more buildings for each extra one (0 for at most one)
+	minVillage int
+	perVillage int
+	// Footprint rules, and the shapes the footprint can take
+	fits   func(r rect) bool
+	shapes []int
+	// Sign hung by the door, or "" for none
+	sign string
+	// Decoration placed outside the front wall
+	decoration rune
+	// NPC tile for the owner, and the roles of the NPCs
+	owner rune
+	roles string
+}
+
+var buildingTypes = []buildingType{
+	buildingHouse: {"House", 0, 0, 0,
+		func(r rect) bool { return true },
+		[]int{FootprintRect, FootprintRect, FootprintL},
+		"", flower, player, "family"},
+	buildingShop: {"Shop", 4, 3, 6,
+		func(r rect) bool { return true },
+		[]int{FootprintRect},
+		"coin", pot, shopkeeper, "shopkeeper,customer"},
+	buildingTavern: {"Tavern", 4, 4, 15,
+		func(r rect) bool { return r.w >= r.h },
+		[]int{FootprintRect, FootprintT},
+		"mug", table, assistant, "barkeep,patron"},
+	buildingSmithy: {"Smithy", 4, 6, 0,
+		func(r rect) bool { return true },
+		[]int{FootprintRect},
+		"anvil", shelf, shopkeeper, "smith,apprentice"},
+	buildingTemple: {"Temple", 6, 8, 0,
+		func(r rect) bool { return r.h > r.w },
+		[]int{FootprintCross, FootprintT},
+		"", flower, assistant, "priest,worshipper"},
+	buildingTownHall: {"Town hall", 9, 12, 0,
+		func(r rect) bool { return r.w*r.h >= 36 },
+		[]int{FootprintCourtyard, FootprintU},
+		"banner", pot, assistant, "mayor,clerk"},
+}
+
+// Assign functional types to buildings, from the most important down: the
+// rarer types go first, limited by the size of the village and each type's
+// footprint rules, and the rest are houses
+func assignBuildingTypes(buildings []building) {
+	order := make([]int, len(buildings))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return buildings[order[i]].importance > buildings[order[j]].importance
+	})
+	quotas := make([]int, len(buildingTypes))
+	for t, bt := range buildingTypes {
+		if t == buildingHouse || len(buildings) < bt.minVillage {
+			continue
+		}
+		quotas[t] = 1
+		if bt.perVillage > 0 {
+			quotas[t] += len(buildings) / bt.perVillage
+		}
+	}
+	for _, i := range order {
+		b := &buildings[i]
+		b.buildingType = buildingHouse
+		for t := buildingTownHall; t > buildingHouse; t-- {
+			bt := buildingTypes[t]
+			if quotas[t] > 0 && b.importance >= bt.minImportance && bt.fits(b.r) {
+				b.buildingType = t
+				quotas[t]--
+				break
+			}
+		}
+	}
+}
+
+// Give buildings footprints out of the shapes for their type, where they fit
+func assignBuildingShapes(rr *rand.Rand, buildings []building) {
+	for i := range buildings {
+		b := &buildings[i]
+		b.fp = randomFootprint(rr, b.r, buildingTypes[b.buildingType].shapes...)
+	}
+}
+
+// Decorate the yard in front of each building, clear of the entrance and any
+// paths, by clearing trees away
+func addDecorations(rr *rand.Rand, m *Map, exportFunc func(*Map), g, s, f *Layer, buildings []building) {
+	for _, b := range buildings {
+		bt := buildingTypes[b.buildingType]
+		w, depth := b.frameSize()
+		e := b.doors[0].outside()
+		eu, _ := b.toLocal(e.x, e.y)
+		for u := -1; u <= w; u++ {
+			x, y := b.local(u, depth+1)
+			wx, wy := b.local(u, depth)
+			if Abs(u-eu) <= 1 || !b.fp.isIn(wx, wy) || !isYard(g, s, f, x, y) ||
+				rr.Intn(2) == 0 {
+				continue
+			}
+			s.setTile(x, y, nothing)
+			f.setTile(x, y, bt.decoration)
+			if bt.decoration != table {
+				continue
+			}
+			// Chairs around tables
+			for _, cu := range []int{u - 1, u + 1} {
+				cx, cy := b.local(cu, depth+1)
+				if Abs(cu-eu) > 1 && isYard(g, s, f, cx, cy) {
+					s.setTile(cx, cy, nothing)
+					f.setTile(cx, cy, chair)
+				}
+			}
+		}
+		exportFunc(m)
+	}
+}
+
+func isYard(g, s, f *Layer, x, y int) bool {
+	t := s.getTile(x, y)
+	return g.isIn(x, y) && g.getTile(x, y) == grass && (t == nothing || t == tree) &&
+		f.getTile(x, y) == nothing
+}
+
+// Record each building's type, sign and NPC roles as map objects
+func addBuildingObjects(m *Map, buildings []building) {
+	counts := map[int]int{}
+	for _, b := range buildings {
+		bt := buildingTypes[b.buildingType]
+		counts[b.buildingType]++
+		m.AddObject(bt.name+" "+strconv.Itoa(counts[b.buildingType]), "building",
+			b.r.x, b.r.y, b.r.w, b.r.h, map[string]string{
+				"type":       bt.name,
+				"importance": strconv.Itoa(b.importance),
+				"sign":       bt.sign,
+				"roles":      bt.roles,
+			})
+	}
+}
@@ -0,0 +1,231 @@
+package gmgmap
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Gap between buildings and the town wall, leaving room for a street
+	// inside
+	townWallMargin = 3
+	// Gap between buildings and the edge of a walled village, leaving room
+	// for the wall, its towers, and roads leaving the gates
+	townWallInset = townWallMargin + 2
+)
+
+// Area of a village to place buildings in, inside the town wall
+func townInterior(r rect) rect {
+	return rect{r.x + townWallInset, r.y + townWallInset,
+		r.w - townWallInset*2, r.h - townWallInset*2}
+}
+
+// Convex hull of points, using the monotone chain algorithm
+func convexHull(points []vec2) []vec2 {
+	points = append([]vec2{}, points...)
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].x != points[j].x {
+			return points[i].x < points[j].x
+		}
+		return points[i].y < points[j].y
+	})
+	if len(points) < 3 {
+		return points
+	}
+	var hull []vec2
+	// Lower then upper hull
+	for pass := 0; pass < 2; pass++ {
+		start := len(hull)
+		for _, p := range points {
+			for len(hull) >= start+2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+				hull = hull[:len(hull)-1]
+			}
+			hull = append(hull, p)
+		}
+		// The last point is the first of the other half
+		hull = hull[:len(hull)-1]
+		for i, j := 0, len(points)-1; i < j; i, j = i+1, j-1 {
+			points[i], points[j] = points[j], points[i]
+		}
+	}
+	return hull
+}
+
+func cross(o, a, b vec2) int {
+	return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+}
+
+// A town wall following the convex hull of the buildings. Hull points are at
+// the corners of tiles, doubled so that tile centres are whole numbers.
+type townWall struct {
+	hull []vec2
+	r    rect
+}
+
+func newTownWall(buildings []building, market rect) townWall {
+	var points []vec2
+	rects := []rect{market}
+	for _, b := range buildings {
+		rects = append(rects, b.r)
+	}
+	bounds := rect{}
+	for _, r := range rects {
+		if r.w == 0 {
+			continue
+		}
+		m := townWallMargin
+		x0, y0, x1, y1 := r.x-m, r.y-m, r.x+r.w+m, r.y+r.h+m
+		points = append(points, vec2{x0 * 2, y0 * 2}, vec2{x1 * 2, y0 * 2},
+			vec2{x0 * 2, y1 * 2}, vec2{x1 * 2, y1 * 2})
+		if bounds.w == 0 {
+			bounds = rect{x0, y0, x1 - x0, y1 - y0}
+		} else {
+			bx1, by1 := imax(bounds.x+bounds.w, x1), imax(bounds.y+bounds.h, y1)
+			bounds.x, bounds.y = imin(bounds.x, x0), imin(bounds.y, y0)
+			bounds.w, bounds.h = bx1-bounds.x, by1-bounds.y
+		}
+	}
+	return townWall{convexHull(points), bounds}
+}
+
+// Whether the centre of a tile is within the hull
+func (tw townWall) isIn(x, y int) bool {
+	if len(tw.hull) < 3 {
+		return false
+	}
+	p := vec2{x*2 + 1, y*2 + 1}
+	for i, a := range tw.hull {
+		if cross(a, tw.hull[(i+1)%len(tw.hull)], p) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a tile is on the wall: inside, next to a tile outside, including
+// diagonally so that the wall has no gaps
+func (tw townWall) isOutline(x, y int) bool {
+	if !tw.isIn(x, y) {
+		return false
+	}
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			if !tw.isIn(x+dx, y+dy) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Find a place for a gate on the side of the wall facing a direction: on a
+// straight stretch of wall, as far out and as close to the middle as possible
+func (tw townWall) findGate(facing int) (buildingDoor, bool) {
+	o := walkOffsets[facing-DirectionUp]
+	t := walkOffsets[(facing-DirectionUp+1)%4]
+	cx, cy := tw.r.x+tw.r.w/2, tw.r.y+tw.r.h/2
+	var best buildingDoor
+	found := false
+	bestOut, bestOff := 0, 0
+	for y := tw.r.y; y < tw.r.y+tw.r.h; y++ {
+		for x := tw.r.x; x < tw.r.x+tw.r.w; x++ {
+			if !tw.isOutline(x, y) || tw.isIn(x+o.x, y+o.y) ||
+				!tw.isIn(x-o.x, y-o.y) || tw.isOutline(x-o.x, y-o.y) ||
+				!tw.isOutline(x+t.x, y+t.y) || !tw.isOutline(x-t.x, y-t.y) {
+				continue
+			}
+			out := (x-cx)*o.x + (y-cy)*o.y
+			off := Abs((x-cx)*t.x + (y-cy)*t.y)
+			if !found || out > bestOut || (out == bestOut && off < bestOff) {
+				best = buildingDoor{vec2{x, y}, facing}
+				bestOut, bestOff = out, off
+				found = true
+			}
+		}
+	}
+	return best, found
+}
+
+// Enclose the buildings of a village in a wall: a palisade for small
+// villages, or stone walls for towns. Gatehouses let roads through on up to
+// four sides, and towers stand at the corners.
+// Each part is recorded as a map object; returns the gates.
+func addTownWall(rr *rand.Rand, m *Map, exportFunc func(*Map), s *Layer, r rect, buildings []building, market rect) []buildingDoor {
+	tw := newTownWall(buildings, market)
+	name, tileWall := "Palisade", fence
+	if len(buildings) >= 8 {
+		name, tileWall = "Town wall", wall2
+	}
+	for y := tw.r.y; y < tw.r.y+tw.r.h; y++ {
+		for x := tw.r.x; x < tw.r.x+tw.r.w; x++ {
+			if tw.isOutline(x, y) {
+				s.setTile(x, y, tileWall)
+			}
+		}
+	}
+	m.AddObject(name, "wall", tw.r.x, tw.r.y, tw.r.w, tw.r.h, map[string]string{})
+	exportFunc(m)
+
+	// Gates on all sides of towns, otherwise on opposite sides
+	facings := []int{DirectionDown, DirectionUp}
+	if len(buildings) >= 8 {
+		facings = append(facings, DirectionLeft, DirectionRight)
+	} else if rr.Intn(2) == 0 {
+		facings = []int{DirectionLeft, DirectionRight}
+	}
+	var gates []buildingDoor
+	for _, facing := range facings {
+		gate, ok := tw.findGate(facing)
+		out := gate.outside()
+		if !ok || !r.isIn(out.x, out.y) {
+			continue
+		}
+		gates = append(gates, gate)
+		// A passage through the gatehouse, with walls either side
+		t := walkOffsets[(facing-DirectionUp+1)%4]
+		for _, p := range []vec2{gate.inside(), gate.vec2, out} {
+			s.setTile(p.x, p.y, nothing)
+			s.setTile(p.x+t.x, p.y+t.y, tileWall)
+			s.setTile(p.x-t.x, p.y-t.y, tileWall)
+		}
+		in := gate.inside()
+		x0, y0 := imin(in.x, out.x)-Abs(t.x), imin(in.y, out.y)-Abs(t.y)
+		x1, y1 := imax(in.x, out.x)+Abs(t.x), imax(in.y, out.y)+Abs(t.y)
+		m.AddObject("Gatehouse "+strconv.Itoa(len(gates)), "gatehouse",
+			x0, y0, x1-x0+1, y1-y0+1, map[string]string{})
+		exportFunc(m)
+	}
+
+	// Towers at the corners, where they're clear of gates and other towers
+	var towers []vec2
+	for _, v := range tw.hull {
+		var t vec2
+		best := -1
+		for y := tw.r.y; y < tw.r.y+tw.r.h; y++ {
+			for x := tw.r.x; x < tw.r.x+tw.r.w; x++ {
+				d := manhattanDistance(x*2+1, y*2+1, v.x, v.y)
+				if tw.isOutline(x, y) && (best < 0 || d < best) {
+					t, best = vec2{x, y}, d
+				}
+			}
+		}
+		clear := best >= 0
+		for _, other := range towers {
+			clear = clear && manhattanDistance(t.x, t.y, other.x, other.y) > 4
+		}
+		for _, gate := range gates {
+			clear = clear && manhattanDistance(t.x, t.y, gate.x, gate.y) > 4
+		}
+		if !clear {
+			continue
+		}
+		towers = append(towers, t)
+		tower := rect{t.x - 1, t.y - 1, 3, 3}
+		s.rectangle(tower, tileWall, true)
+		m.AddObject("Tower "+strconv.Itoa(len(towers)), "tower", tower.x, tower.y, tower.w, tower.h,
+			map[string]string{})
+	}
+	exportFunc(m)
+	return gates
+}
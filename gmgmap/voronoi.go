@@ -0,0 +1,185 @@
+package gmgmap
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+// Region border types
+const (
+	BorderNone = iota
+	BorderWall
+	BorderRoad
+)
+
+// NewVoronoi - create a map partitioned into regions, like districts or
+// biomes, using a discrete Voronoi diagram of random seed points.
+// Lloyd relaxation moves each seed point to the centre of its region, and is
+// repeated to make the regions more even in size.
+// Each region is given a random biome and recorded as a map object; borders
+// between regions can be drawn as walls or roads.
+// There is at least one region.
+func NewVoronoi(rr *rand.Rand, exportFunc func(*Map), width, height, numRegions, relaxations, border int) *Map {
+	m := NewMap(width, height)
+	g := m.Layer("Ground")
+	s := m.Layer("Structures")
+	numRegions = imax(numRegions, 1)
+
+	v := newVoronoi(rr, width, height, numRegions, relaxations)
+
+	biomes := []struct {
+		name              string
+		ground, structure rune
+	}{
+		{"grass", grass, nothing},
+		{"forest", grass, tree},
+		{"sand", sand, nothing},
+		{"hills", grass, hill},
+	}
+	regionBiomes := make([]int, len(v.sites))
+	for i := range regionBiomes {
+		regionBiomes[i] = rr.Intn(len(biomes))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			biome := biomes[regionBiomes[v.region(x, y)]]
+			g.setTile(x, y, biome.ground)
+			s.setTile(x, y, biome.structure)
+		}
+	}
+	exportFunc(m)
+
+	v.addBorders(g, s, border)
+	exportFunc(m)
+
+	for i := range v.sites {
+		// Relaxation can leave regions empty
+		if _, area := v.bounds(i); area == 0 {
+			continue
+		}
+		o := v.addObject(m, i)
+		o.Properties["biome"] = biomes[regionBiomes[i]].name
+	}
+
+	return m
+}
+
+// A discrete Voronoi partition, where each tile belongs to the region of its
+// closest site
+type voronoi struct {
+	sites   []vec2
+	regions []int
+	width   int
+	height  int
+}
+
+func newVoronoi(rr *rand.Rand, width, height, numSites, relaxations int) voronoi {
+	v := voronoi{nil, make([]int, width*height), width, height}
+	for i := 0; i < numSites; i++ {
+		v.sites = append(v.sites, vec2{rr.Intn(width), rr.Intn(height)})
+	}
+	v.partition()
+	for i := 0; i < relaxations; i++ {
+		v.relax()
+		v.partition()
+	}
+	return v
+}
+
+func (v voronoi) partition() {
+	for y := 0; y < v.height; y++ {
+		for x := 0; x < v.width; x++ {
+			closest := 0
+			closestDistance := -1
+			for i, site := range v.sites {
+				dx, dy := x-site.x, y-site.y
+				d := dx*dx + dy*dy
+				if closestDistance < 0 || d < closestDistance {
+					closest = i
+					closestDistance = d
+				}
+			}
+			v.regions[x+y*v.width] = closest
+		}
+	}
+}
+
+// Lloyd relaxation: move each site to the centroid of its region
+func (v voronoi) relax() {
+	sumX := make([]int, len(v.sites))
+	sumY := make([]int, len(v.sites))
+	count := make([]int, len(v.sites))
+	for i, region := range v.regions {
+		sumX[region] += i % v.width
+		sumY[region] += i / v.width
+		count[region]++
+	}
+	for i := range v.sites {
+		if count[i] > 0 {
+			v.sites[i] = vec2{sumX[i] / count[i], sumY[i] / count[i]}
+		}
+	}
+}
+
+func (v voronoi) region(x, y int) int {
+	return v.regions[x+y*v.width]
+}
+
+// Whether a tile is on the border with another region; only the tiles on the
+// top/left of each border are counted, so borders are one tile thick
+func (v voronoi) isBorder(x, y int) bool {
+	region := v.region(x, y)
+	return (x < v.width-1 && v.region(x+1, y) != region) ||
+		(y < v.height-1 && v.region(x, y+1) != region)
+}
+
+// Bounding rectangle and area of a region
+func (v voronoi) bounds(region int) (rect, int) {
+	x1, y1, x2, y2 := v.width, v.height, -1, -1
+	area := 0
+	for i, r := range v.regions {
+		if r != region {
+			continue
+		}
+		x, y := i%v.width, i/v.width
+		x1, y1 = imin(x1, x), imin(y1, y)
+		x2, y2 = imax(x2, x), imax(y2, y)
+		area++
+	}
+	if area == 0 {
+		return rect{}, 0
+	}
+	return rect{x1, y1, x2 - x1 + 1, y2 - y1 + 1}, area
+}
+
+func (v voronoi) addBorders(g, s *Layer, border int) {
+	if border == BorderNone {
+		return
+	}
+	for y := 0; y < v.height; y++ {
+		for x := 0; x < v.width; x++ {
+			isEdge := x == 0 || y == 0 || x == v.width-1 || y == v.height-1
+			switch {
+			case border == BorderWall && (isEdge || v.isBorder(x, y)):
+				s.setTile(x, y, wall)
+			case border == BorderRoad && v.isBorder(x, y):
+				g.setTile(x, y, road)
+				s.setTile(x, y, nothing)
+			}
+		}
+	}
+}
+
+// Record a region as a map object, with its bounds, site and area
+func (v voronoi) addObject(m *Map, region int) *Object {
+	r, area := v.bounds(region)
+	site := v.sites[region]
+	return m.AddObject(fmt.Sprintf("Region %d", region), "region",
+		r.x, r.y, r.w, r.h, map[string]string{
+			"region": strconv.Itoa(region),
+			"siteX":  strconv.Itoa(site.x),
+			"siteY":  strconv.Itoa(site.y),
+			"area":   strconv.Itoa(area),
+		})
+}
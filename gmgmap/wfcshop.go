@@ -1,6 +1,7 @@
 package gmgmap
 
 import (
+	"container/heap"
 	"fmt"
 	"math"
 	"math/rand"
@@ -62,57 +63,70 @@ func NewWFCShop(rr *rand.Rand, exportFunc func(*Map), width, height int) *Map {
 	// Collapse waves until everything is collapsed
 	collapseCounter := 0
 	cd := 16
+	onCollapse := func(x, y int, t rune) {
+		applyCollapsedValue(x, y, t, g, s, f)
+		if collapseCounter == 0 {
+			exportFunc(m)
+			collapseCounter = cd
+			cd *= 2
+		}
+		collapseCounter -= 1
+	}
+	// Every tile starts off in the propagation queue so that all the rules get
+	// applied at least once; after that only neighbours of changed tiles are
+	// revisited
+	queue := newPropagationQueue(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			queue.push(x, y)
+		}
+	}
+	entropies := &tileHeap{}
 	for {
-		autoCollapsed := false
-		// Apply rules on every uncollapsed tile to set up the waves
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				if superpositions.get(x, y).isCollapsed() {
-					continue
-				}
-				for _, rule := range rules {
-					newSP := rule(superpositions, x, y)
-					if newSP != nil {
-						superpositions.set(x, y, newSP)
-					}
-				}
-				newCV := superpositions.get(x, y).collapsedValue()
-				if newCV != nothing {
-					autoCollapsed = true
-					applyCollapsedValue(x, y, newCV, g, s, f)
-					if collapseCounter == 0 {
-						exportFunc(m)
-						collapseCounter = cd
-						cd *= 2
-					}
-					collapseCounter -= 1
+		// Apply rules on queued tiles until the waves settle
+		for !queue.isEmpty() {
+			x, y := queue.pop()
+			if superpositions.get(x, y).isCollapsed() {
+				continue
+			}
+			changed := false
+			for _, rule := range rules {
+				newSP := rule(superpositions, x, y)
+				if newSP != nil {
+					superpositions.set(x, y, newSP)
+					changed = true
 				}
 			}
+			if !changed {
+				continue
+			}
+			sp := superpositions.get(x, y)
+			newCV := sp.collapsedValue()
+			if newCV != nothing {
+				onCollapse(x, y, newCV)
+				queue.pushNeighbours(x, y, propagationRadius)
+			} else if entropy := sp.entropy(); !math.IsInf(entropy, 0) {
+				heap.Push(entropies, tilePriority{entropy, x, y})
+			}
 		}
 
 		// Choose the non-collapsed tile with lowest entropy
-		minEntropy := math.Inf(0)
-		minX := 0
-		minY := 0
-		for y := 0; y < height; y++ {
-			for x := 0; x < width; x++ {
-				sp := superpositions.get(x, y)
-				if sp.isCollapsed() {
-					continue
-				}
-				entropy := sp.entropy()
-				if entropy < minEntropy {
-					minEntropy = entropy
-					minX = x
-					minY = y
-				}
+		// Entries are not removed when tiles change, so skip any that are stale
+		minX, minY := -1, -1
+		for entropies.Len() > 0 {
+			e := heap.Pop(entropies).(tilePriority)
+			sp := superpositions.get(e.x, e.y)
+			if sp.isCollapsed() || sp.entropy() != e.priority {
+				continue
 			}
+			minX, minY = e.x, e.y
+			break
 		}
-		if minEntropy == math.Inf(0) && !autoCollapsed {
+		if minX < 0 {
 			// We can't collapse anymore
 			break
 		}
-		// Collapse the highest entropy tile
+		// Collapse the lowest entropy tile
 		// Just select the highest weight
 		// TODO: investigate other methods of collapse
 		var maxKey rune
@@ -124,13 +138,8 @@ func NewWFCShop(rr *rand.Rand, exportFunc func(*Map), width, height int) *Map {
 			}
 		}
 		superpositions.set(minX, minY, Superposition{maxKey: 1.0})
-		applyCollapsedValue(minX, minY, maxKey, g, s, f)
-		if collapseCounter == 0 {
-			exportFunc(m)
-			collapseCounter = cd
-			cd *= 2
-		}
-		collapseCounter -= 1
+		onCollapse(minX, minY, maxKey)
+		queue.pushNeighbours(minX, minY, propagationRadius)
 	}
 	exportFunc(m)
 	// Collapse uncollapsed tiles with default rule
@@ -231,8 +240,57 @@ func newSuperpositions(m *Map) *Superpositions {
 	return s
 }
 
+// Rule - a WFC rule, returning a new superposition for a tile or nil if the
+// rule doesn't apply.
+// Rules may only depend on collapsed tiles up to propagationRadius away, so
+// that tiles only need to be revisited when their neighbours collapse.
 type Rule func(s *Superpositions, x, y int) Superposition
 
+const propagationRadius = 1
+
+// Queue of tiles that need to have rules reapplied; each tile is only queued
+// once at a time
+type propagationQueue struct {
+	indices []int
+	queued  []bool
+	width   int
+	height  int
+}
+
+func newPropagationQueue(width, height int) *propagationQueue {
+	return &propagationQueue{nil, make([]bool, width*height), width, height}
+}
+
+func (q *propagationQueue) isEmpty() bool {
+	return len(q.indices) == 0
+}
+
+func (q *propagationQueue) push(x, y int) {
+	i := x + y*q.width
+	if q.queued[i] {
+		return
+	}
+	q.queued[i] = true
+	q.indices = append(q.indices, i)
+}
+
+func (q *propagationQueue) pushNeighbours(x, y, r int) {
+	for yi := imax(y-r, 0); yi <= imin(y+r, q.height-1); yi++ {
+		for xi := imax(x-r, 0); xi <= imin(x+r, q.width-1); xi++ {
+			if xi != x || yi != y {
+				q.push(xi, yi)
+			}
+		}
+	}
+}
+
+func (q *propagationQueue) pop() (int, int) {
+	i := q.indices[0]
+	q.indices = q.indices[1:]
+	q.queued[i] = false
+	return i % q.width, i / q.width
+}
+
 func roadAtEdgeRule(s *Superpositions, x, y int) Superposition {
 	if x == 0 || y == 0 || x == s.m.Width-1 || y == s.m.Height-1 {
 		return Superposition{road: 1.0}
@@ -14,20 +14,55 @@ import (
 )
 
 func main() {
-	algo := flag.String("algo", "bspinterior", "generation algorithm: bsp/bspinterior/cell/rogue/shop/wfcshop/walk/village")
+	algo := flag.String("algo", "bspinterior", "generation algorithm: bsp/bspinterior/building/cell/city/cyclic/dla/drunkard/overworld/region/rogue/shop/tunneler/voronoi/wfcshop/walk/village")
 	template := flag.String("template", "dawnlike", "TMX export template: dawnlike/kenney")
 	width := flag.Int("width", 32, "map width")
 	height := flag.Int("height", 32, "map height")
 	export := flag.Bool("export", true, "enable TMX export")
 	iterations := flag.Int("iterations", 3000, "number of iterations for walk algo")
-	gridWidth := flag.Int("gridwidth", 3, "grid size, for rogue algo")
-	gridHeight := flag.Int("gridheight", 3, "grid size, for rogue algo")
+	gridWidth := flag.Int("gridwidth", 3, "grid size, for rogue/cyclic algos")
+	gridHeight := flag.Int("gridheight", 3, "grid size, for rogue/cyclic algos")
 	minRoomPct := flag.Int("minroompct", 50, "percent of rooms per grid, for rogue algo")
 	maxRoomPct := flag.Int("maxroompct", 100, "percent of rooms per grid, for rogue algo")
-	fillPct := flag.Int("fillpct", 40, "initial fill percent, for cell algo")
+	fillPct := flag.Int("fillpct", 40, "initial fill percent for cell algo, or target floor percent for dla/drunkard algos")
 	r1 := flag.Int("r1", 5, "R1 cutoff, for cell algo")
 	r2 := flag.Int("r2", 2, "R2 cutoff, for cell algo")
 	reps := flag.Int("reps", 4, "reps, for cell algo")
+	rules := flag.String("rules", "",
+		"birth/survival rule schedule for cell algo, e.g. B5678/S45678x4,B5678/S5678x3; overrides r1/r2/reps")
+	connect := flag.Int(
+		"connect", gmgmap.ConnectChain,
+		"area connection for cell algo; 0=chain, 1=minimum spanning tree")
+	tunnel := flag.Int(
+		"tunnel", gmgmap.TunnelStraight,
+		"tunnels between areas for cell algo; 0=straight, 1=organic")
+	minAreaSize := flag.Int(
+		"minareasize", 0, "fill in areas smaller than this instead of connecting them, for cell algo")
+	waterPct := flag.Int("water", 0, "percent of floor to cover with water, for cell algo")
+	lavaPct := flag.Int("lava", 0, "percent of floor to cover with lava, for cell algo")
+	chasmPct := flag.Int("chasm", 0, "percent of floor to cover with chasms, for cell algo")
+	seeding := flag.Int(
+		"seeding", gmgmap.DLASeedCentre, "seed for dla algo; 0=centre, 1=bottom")
+	spawn := flag.Int(
+		"spawn", gmgmap.DLASpawnEdge, "particle spawn for dla algo; 0=edge, 1=random")
+	bias := flag.Int(
+		"bias", 0, "percent chance to move towards the seed, for dla algo")
+	walkers := flag.Int("walkers", 4, "maximum number of walkers, for drunkard algo")
+	spawnPct := flag.Int("spawnpct", 5, "percent chance to spawn a walker/tunneler, for drunkard/tunneler algos")
+	deathPct := flag.Int("deathpct", 2, "percent chance for a walker to die, for drunkard algo")
+	direction := flag.Int(
+		"direction", gmgmap.DirectionNone,
+		"bias direction for drunkard algo; 0=none, 1=up, 2=right, 3=down, 4=left")
+	walkBias := flag.Int(
+		"walkbias", 0, "percent chance to walk in the bias direction, for drunkard algo")
+	persistence := flag.Int(
+		"persistence", 50, "percent chance to keep walking the same way, for drunkard algo")
+	walkMode := flag.Int(
+		"walkmode", gmgmap.WalkDungeon, "walked tiles for drunkard algo; 0=trees, 1=dungeon")
+	lifespan := flag.Int("lifespan", 30, "tunneler lifespan, for tunneler algo")
+	roomPct := flag.Int(
+		"roompct", 50, "percent chance to place a room when turning, for tunneler algo")
+	cycles := flag.Int("cycles", 4, "number of sub-cycles to insert, for cyclic algo")
 	splits := flag.Int("splits", 4, "number of splits for bsp/bspinterior algo")
 	minRoomSize := flag.Int("minroomsize", 5, "minimum room width/height")
 	maxRoomSize := flag.Int("maxroomsize", 10, "maximum room width/height")
@@ -36,10 +71,42 @@ func main() {
 	lobbyEdgeType := flag.Int(
 		"lobbyedge", gmgmap.LobbyEdge,
 		"lobby placement for interior algo; 0=edge, 1=interior, 2=any")
+	shape := flag.Int(
+		"shape", gmgmap.FootprintRect,
+		"building footprint for interior algo; 0=rect, 1=L, 2=T, 3=U, 4=courtyard, 5=cross")
 	buildingPadding := flag.Int(
 		"buildingPadding", 1, "padding between village buildings")
 	corridorWidth := flag.Int(
-		"corridorWidth", 1, "width of corridors (bspinterior only)")
+		"corridorWidth", 1, "width of corridors (bspinterior), or maximum width (tunneler)")
+	featureSize := flag.Int(
+		"featuresize", 16, "approximate size of terrain features, for overworld/region algos")
+	rivers := flag.Int(
+		"rivers", 0, "number of rivers, for overworld/region/village/walk algos")
+	regions := flag.Int("regions", 8, "number of regions, for voronoi algo")
+	relaxations := flag.Int(
+		"relaxations", 2, "Lloyd relaxation iterations, for voronoi algo")
+	border := flag.Int(
+		"border", gmgmap.BorderWall,
+		"borders between regions for voronoi algo; 0=none, 1=wall, 2=road")
+	villages := flag.Int("villages", 4, "number of villages, for region algo")
+	cityLayout := flag.Int(
+		"citylayout", gmgmap.CityGrid, "road layout for city algo; 0=grid, 1=organic")
+	districts := flag.Int("districts", 5, "number of districts, for city algo")
+	landmarks := flag.Int("landmarks", 3, "number of landmarks, for region algo")
+	prefabs := flag.Int("prefabs", 0, "number of prefabs to stamp into the map")
+	prefabFile := flag.String(
+		"prefabfile", "", "file of ASCII prefabs to stamp; uses built-in prefabs if empty")
+	locks := flag.Int("locks", 0, "number of coloured locks and keys to add to the map")
+	checkLocks := flag.Bool("checklocks", false, "check that the map's locks and keys are solvable")
+	levels := flag.Int("levels", 1, "number of dungeon levels, linked by stairs")
+	depthScale := flag.Int(
+		"depthscale", 0, "percent to grow map size and number of locks and prefabs per level")
+	floors := flag.Int("floors", 2, "number of storeys above ground, for building algo")
+	basements := flag.Int("basements", 0, "number of basement levels, for building algo")
+	roof := flag.Bool("roof", false, "add a roof level, for building algo")
+	layered := flag.Bool("layered", false, "export levels as layer groups in one TMX")
+	interiors := flag.Bool("interiors", false, "furnish building interiors, for city/village algos")
+	walled := flag.Bool("walled", false, "enclose villages in walls with gates, for region/village algos")
 	seed := flag.Int64("seed", time.Now().UTC().UnixNano(), "random seed")
 	flag.Parse()
 	// make map
@@ -47,7 +114,6 @@ func main() {
 	rr := rand.New(rand.NewSource(*seed))
 	// Use different RNG for export
 	rr2 := rand.New(rand.NewSource(*seed))
-	m := gmgmap.NewMap(*width, *height)
 	t := &gmgmap.DawnLikeTemplate
 	switch *template {
 	case "dawnlike":
@@ -79,31 +145,130 @@ func main() {
 		}
 	}
 
-	switch *algo {
-	case "bsp":
-		m = gmgmap.NewBSP(rr, *width, *height, *splits, *minRoomSize, *connectionIterations)
-	case "bspinterior":
-		m = gmgmap.NewBSPInterior(rr, exportFunc, *width, *height, *splits, *minRoomSize, *corridorWidth)
-	case "cell":
-		m = gmgmap.NewCellularAutomata(rr, *width, *height, *fillPct, *reps, *r1, *r2)
-	case "interior":
-		m = gmgmap.NewInterior(
-			rr, *width, *height, *minRoomSize, *maxRoomSize, *lobbyEdgeType)
-	case "rogue":
-		m = gmgmap.NewRogue(rr, *width, *height, *gridWidth, *gridHeight,
-			*minRoomPct, *maxRoomPct)
-	case "shop":
-		m = gmgmap.NewShop(rr, exportFunc, *width, *height)
-	case "walk":
-		m = gmgmap.NewRandomWalk(rr, *width, *height, *iterations)
-	case "wfcshop":
-		m = gmgmap.NewWFCShop(rr, exportFunc, *width, *height)
-	case "village":
-		m = gmgmap.NewVillage(rr, exportFunc, *width, *height, *buildingPadding)
+	newLevel := func(depth int) *gmgmap.Map {
+		width := gmgmap.ScaleByDepth(*width, *depthScale, depth)
+		height := gmgmap.ScaleByDepth(*height, *depthScale, depth)
+		numPrefabs := gmgmap.ScaleByDepth(*prefabs, *depthScale, depth)
+		m := gmgmap.NewMap(width, height)
+		switch *algo {
+		case "bsp":
+			m = gmgmap.NewBSP(rr, width, height, *splits, *minRoomSize, *connectionIterations)
+		case "bspinterior":
+			m = gmgmap.NewBSPInterior(rr, exportFunc, width, height, *splits, *minRoomSize, *corridorWidth)
+		case "cell":
+			caveOpts := gmgmap.CaveOptions{Connect: *connect, Tunnel: *tunnel, MinAreaSize: *minAreaSize}
+			if *rules != "" {
+				caRules, err := gmgmap.ParseCARules(*rules)
+				if err != nil {
+					panic(err)
+				}
+				m = gmgmap.NewCellularAutomataRulesWithOptions(
+					rr, width, height, *fillPct, caRules, caveOpts)
+			} else {
+				m = gmgmap.NewCellularAutomataWithOptions(
+					rr, width, height, *fillPct, *reps, *r1, *r2, caveOpts)
+			}
+			gmgmap.AddCaveMaterials(rr, m, *waterPct, *lavaPct, *chasmPct)
+		case "city":
+			m = gmgmap.NewCity(rr, exportFunc, width, height, *cityLayout, *districts, *interiors)
+		case "cyclic":
+			m = gmgmap.NewCyclic(rr, exportFunc, width, height, *gridWidth, *gridHeight, *cycles)
+		case "dla":
+			m = gmgmap.NewDLA(rr, exportFunc, width, height, *seeding, *spawn, *bias, *fillPct)
+			gmgmap.AddCaveMaterials(rr, m, *waterPct, *lavaPct, *chasmPct)
+		case "drunkard":
+			m = gmgmap.NewDrunkardWalk(rr, exportFunc, width, height, *walkers, *spawnPct,
+				*deathPct, *direction, *walkBias, *persistence, *fillPct, *walkMode)
+		case "interior":
+			m = gmgmap.NewInteriorWithOptions(rr, width, height, *minRoomSize, *maxRoomSize,
+				*lobbyEdgeType, gmgmap.InteriorOptions{Shape: *shape})
+		case "overworld":
+			m = gmgmap.NewOverworldWithOptions(rr, exportFunc, width, height, *featureSize,
+				gmgmap.OverworldOptions{NumRivers: *rivers})
+		case "region":
+			m = gmgmap.NewRegionWithOptions(rr, exportFunc, width, height, *villages, *landmarks,
+				*buildingPadding, *featureSize, gmgmap.RegionOptions{Walled: *walled, NumRivers: *rivers})
+		case "rogue":
+			m = gmgmap.NewRogue(rr, width, height, *gridWidth, *gridHeight,
+				*minRoomPct, *maxRoomPct)
+		case "shop":
+			m = gmgmap.NewShop(rr, exportFunc, width, height)
+		case "tunneler":
+			m = gmgmap.NewTunneler(rr, exportFunc, width, height, *lifespan, *corridorWidth,
+				*spawnPct, *roomPct, *minRoomSize, *maxRoomSize)
+		case "voronoi":
+			m = gmgmap.NewVoronoi(rr, exportFunc, width, height, *regions, *relaxations, *border)
+		case "walk":
+			m = gmgmap.NewRandomWalk(rr, width, height, *iterations)
+			gmgmap.AddRivers(rr, m, *rivers, *featureSize)
+		case "wfcshop":
+			m = gmgmap.NewWFCShop(rr, exportFunc, width, height)
+		case "village":
+			m = gmgmap.NewVillageWithOptions(rr, exportFunc, width, height, *buildingPadding,
+				gmgmap.VillageOptions{Interiors: *interiors, Walled: *walled})
+			gmgmap.AddRivers(rr, m, *rivers, *featureSize)
+		}
+
+		if numPrefabs > 0 {
+			var p []gmgmap.Prefab
+			var err error
+			if *prefabFile != "" {
+				p, err = gmgmap.LoadPrefabs(*prefabFile)
+			} else {
+				p, err = gmgmap.ParsePrefabs(gmgmap.DefaultPrefabs)
+			}
+			if err != nil {
+				panic(err)
+			}
+			gmgmap.StampPrefabs(rr, m, p, numPrefabs)
+		}
+		return m
+	}
+	addLocks := func(m *gmgmap.Map, depth int) {
+		numLocks := gmgmap.ScaleByDepth(*locks, *depthScale, depth)
+		if numLocks > 0 {
+			gmgmap.AddLocksAndKeys(rr, m, numLocks)
+		}
 	}
 
+	var d *gmgmap.Dungeon
+	if *algo == "building" {
+		d = gmgmap.NewBuilding(rr, *width, *height, *floors, *basements,
+			*minRoomSize, *maxRoomSize, *roof)
+	} else if *levels > 1 {
+		d = gmgmap.NewDungeon(rr, *levels, newLevel)
+	}
+	if d != nil {
+		for i, m := range d.Levels {
+			addLocks(m, i)
+			fmt.Println(d.Names[i])
+			m.Print()
+			if *checkLocks {
+				gmgmap.CheckSolvability(m).Print()
+			}
+		}
+		d.PrintLinks()
+		if *export {
+			var err error
+			if *layered {
+				err = d.ToLayeredTMX(rr2, t)
+			} else {
+				err = d.ToTMX(rr2, t)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		return
+	}
+	m := newLevel(0)
+	addLocks(m, 0)
+
 	// print
 	m.Print()
+	if *checkLocks {
+		gmgmap.CheckSolvability(m).Print()
+	}
 	//m.PrintCSV()
 	// export TMX
 	exportFunc(m)